@@ -0,0 +1,119 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/auth"
+
+	"connectrpc.com/connect"
+	"github.com/mitchellh/go-homedir"
+)
+
+// credentials are the ones a client receives when enrolling, stored in its credentials file.
+type credentials struct {
+	KeyID          string   `json:"key_id"`
+	PrivateKeyFile string   `json:"private_key_file"`
+	Scopes         []string `json:"scopes"`
+}
+
+// loadCredentials fills in the key id, private key file and scopes of the client from its credentials file, unless
+// they are configured otherwise (or the file does not exist).
+func loadCredentials(cfg *Config) error {
+	if cfg.SigningKey != "" || cfg.PrivateKeyFile != "" {
+		return nil
+	}
+
+	path, err := homedir.Expand(cfg.CredentialsFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var creds credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return err
+	}
+
+	cfg.KeyID = creds.KeyID
+	cfg.PrivateKeyFile = creds.PrivateKeyFile
+	if _, ok := os.LookupEnv("ARK_CLIENT_SCOPES"); !ok && len(creds.Scopes) > 0 {
+		cfg.Scopes = creds.Scopes
+	}
+
+	return nil
+}
+
+// enroll generates a new key pair, registers its public key with the server using the given enrollment code and stores
+// the private key next to the credentials file.
+func enroll(ctx context.Context, client arkv1connect.ArkApiClient, code, credentialsFile string) (*credentials, error) {
+	path, err := homedir.Expand(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPublicKey, err := auth.MarshalPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPrivateKey, err := auth.MarshalPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Enroll(ctx, connect.NewRequest(&arkv1.EnrollRequest{
+		Code:      code,
+		PublicKey: encodedPublicKey,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	creds := &credentials{
+		KeyID:          res.Msg.GetKeyId(),
+		PrivateKeyFile: filepath.Join(dir, res.Msg.GetKeyId()+".key"),
+		Scopes:         res.Msg.GetScopes(),
+	}
+
+	if err := os.WriteFile(creds.PrivateKeyFile, encodedPrivateKey, 0o600); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
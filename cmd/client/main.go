@@ -4,14 +4,25 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"text/tabwriter"
 	"time"
 
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
 	"github.com/fedragon/ark/internal/auth"
+	"github.com/fedragon/ark/internal/downloader"
+	"github.com/fedragon/ark/internal/fs"
 	"github.com/fedragon/ark/internal/importer"
+	"github.com/fedragon/ark/internal/lister"
+	"github.com/fedragon/ark/internal/tlsconfig"
 
 	"connectrpc.com/connect"
 	"github.com/kelseyhightower/envconfig"
@@ -21,15 +32,61 @@ import (
 )
 
 const (
-	fromFlag = "from"
+	fromFlag   = "from"
+	toFlag     = "to"
+	byFlag     = "by"
+	sinceFlag  = "since"
+	untilFlag  = "until"
+	formatFlag = "format"
+	codeFlag   = "code"
+	dryRunFlag = "dry-run"
+	// continueOnErrorFlag is the flag to carry on importing the other files when one fails
+	continueOnErrorFlag = "continue-on-error"
 )
 
 type Config struct {
-	FileTypes  []string `split_words:"true" default:"cr2,orc,jpg,jpeg,mp4,mov,avi,mpg,mpeg,wmv"`
-	SigningKey string   `split_words:"true" required:"true"`
-	Server     struct {
+	FileTypes []string `split_words:"true" default:"cr2,orc,jpg,jpeg,mp4,mov,avi,mpg,mpeg,wmv"`
+	// HashCacheFile keeps the hashes of the files imported so far, so that they are not hashed again unless they change:
+	// the cache is disabled if empty
+	HashCacheFile string `split_words:"true" default:"~/.cache/ark/hashes.json"`
+	// Pipeline sizes the pools of goroutines hashing and uploading files, and the queues between them: zero means as
+	// many hashers and senders as the CPUs, and queues twice as large as the pools they feed
+	Pipeline struct {
+		Hashers         int `split_words:"true"`
+		Senders         int `split_words:"true"`
+		HashQueueSize   int `split_words:"true"`
+		UploadQueueSize int `split_words:"true"`
+	}
+	// Retries tells how uploads failing with transient errors (e.g. the server being restarted) are retried, waiting
+	// for an exponentially growing backoff in between: zero Max disables retries
+	Retries struct {
+		Max            int           `default:"3"`
+		InitialBackoff time.Duration `split_words:"true" default:"1s"`
+		MaxBackoff     time.Duration `split_words:"true" default:"30s"`
+	}
+	// Tokens are signed either with the SigningKey shared with the server (HS256) or with the private key in
+	// PrivateKeyFile (EdDSA or RS256), whose public key is known to the server as KeyID
+	SigningKey     string `split_words:"true"`
+	PrivateKeyFile string `split_words:"true"`
+	KeyID          string `split_words:"true"`
+	// CredentialsFile holds the key id, private key file and scopes received when enrolling, used unless a signing key
+	// or a private key file is configured
+	CredentialsFile string `split_words:"true" default:"~/.config/ark/credentials.json"`
+	// Subject is the name of the client (defaults to the host name), unless tokens are signed with a private key, in
+	// which case it is the key id
+	Subject string
+	Scopes  []string `default:"upload,read"`
+	// TokenLifetime is how long each token is valid for: tokens are renewed shortly before they expire
+	TokenLifetime time.Duration `split_words:"true" default:"24h"`
+	Server        struct {
 		Address  string `split_words:"true" default:"localhost:9999"`
 		Protocol string `default:"http"`
+		// Only used if Protocol is https
+		TLS struct {
+			CAFile   string `split_words:"true"`
+			CertFile string `split_words:"true"`
+			KeyFile  string `split_words:"true"`
+		}
 	}
 }
 
@@ -42,57 +99,436 @@ func main() {
 		log.Fatal("Unable to process config", zap.Error(err))
 	}
 
+	if err := loadCredentials(&cfg); err != nil {
+		log.Fatal("Unable to load credentials", zap.Error(err))
+	}
+
 	app := &cli.App{
 		Usage:           "Imports files to the Ark server",
-		UsageText:       "ark [global options]",
+		UsageText:       "ark [global options] [command [command options] [arguments...]]",
 		Version:         "0.1.0",
 		HideHelpCommand: true,
 		Flags: []cli.Flag{
 			&cli.PathFlag{
-				Name:     fromFlag,
-				Required: true,
-				Usage:    "Absolute path of the directory containing the files to be imported.",
+				Name:  fromFlag,
+				Usage: "Absolute path of the directory containing the files to be imported (required).",
+			},
+			&cli.BoolFlag{
+				Name:  dryRunFlag,
+				Usage: "Only report what would be imported, and where, without uploading anything.",
+			},
+			&cli.BoolFlag{
+				Name:  continueOnErrorFlag,
+				Usage: "Carry on importing the other files when one fails, listing the failures at the end.",
+			},
+			&cli.StringFlag{
+				Name:  formatFlag,
+				Value: importer.FormatTable,
+				Usage: "Output format of the dry run report: 'table' or 'json'.",
+			},
+		},
+	}
+
+	newClient := func() (arkv1connect.ArkApiClient, error) {
+		interceptor, err := newInterceptor(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient, err := newHTTPClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return arkv1connect.NewArkApiClient(
+			httpClient,
+			serverURL(cfg),
+			connect.WithSendGzip(),
+			connect.WithInterceptors(interceptor),
+		), nil
+	}
+
+	openHashCache := func() (*fs.HashCache, error) {
+		path, err := homedir.Expand(cfg.HashCacheFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return fs.OpenHashCache(path)
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:  "cache",
+			Usage: "Manages the cache of file hashes",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "inspect",
+					Usage:     "Lists the cached hashes of the files in a directory (or of all files)",
+					ArgsUsage: "[dir]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  formatFlag,
+							Value: lister.FormatTable,
+							Usage: "Output format: 'table' or 'json'.",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						cache, err := openHashCache()
+						if err != nil {
+							return err
+						}
+
+						return writeCachedHashes(os.Stdout, cache.Entries(c.Args().First()), c.String(formatFlag))
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "Removes the cached hashes of the files that no longer exist or have changed",
+					Action: func(c *cli.Context) error {
+						cache, err := openHashCache()
+						if err != nil {
+							return err
+						}
+
+						log.Info("Pruned hash cache", zap.Int("removed", cache.Prune()))
+						return cache.Save()
+					},
+				},
+				{
+					Name:      "invalidate",
+					Usage:     "Removes the cached hashes of the files in the given directories (or of all files), so that they are hashed again",
+					ArgsUsage: "[dir...]",
+					Action: func(c *cli.Context) error {
+						cache, err := openHashCache()
+						if err != nil {
+							return err
+						}
+
+						dirs := c.Args().Slice()
+						if len(dirs) == 0 {
+							dirs = []string{""}
+						}
+
+						var removed int
+						for _, dir := range dirs {
+							removed += cache.Invalidate(dir)
+						}
+
+						log.Info("Invalidated hash cache", zap.Int("removed", removed))
+						return cache.Save()
+					},
+				},
+			},
+		},
+		{
+			Name:  "enroll",
+			Usage: "Enrolls this client with the server, given the enrollment code created by the server admin",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     codeFlag,
+					Required: true,
+					Usage:    "Enrollment code (valid only once, and only for a short time).",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				httpClient, err := newHTTPClient(cfg)
+				if err != nil {
+					return err
+				}
+
+				// the enrollment code authenticates the client, which has no token yet
+				client := arkv1connect.NewArkApiClient(httpClient, serverURL(cfg))
+
+				creds, err := enroll(context.Background(), client, c.String(codeFlag), cfg.CredentialsFile)
+				if err != nil {
+					return err
+				}
+
+				log.Info("Enrolled", zap.String("key_id", creds.KeyID), zap.Strings("scopes", creds.Scopes))
+				return nil
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "Lists archived media, sorted by creation (or import) date",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  byFlag,
+					Value: "created",
+					Usage: "Date to filter and sort by: 'created' or 'imported'.",
+				},
+				&cli.TimestampFlag{
+					Name:   sinceFlag,
+					Layout: "2006-01-02",
+					Usage:  "Only list media dated on or after this day (e.g. 2019-03-01).",
+				},
+				&cli.TimestampFlag{
+					Name:   untilFlag,
+					Layout: "2006-01-02",
+					Usage:  "Only list media dated before this day (e.g. 2019-04-01).",
+				},
+				&cli.StringFlag{
+					Name:  formatFlag,
+					Value: lister.FormatTable,
+					Usage: "Output format: 'table' or 'json'.",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				query := lister.Query{
+					From: c.Timestamp(sinceFlag),
+					To:   c.Timestamp(untilFlag),
+				}
+
+				switch c.String(byFlag) {
+				case "created":
+					query.By = arkv1.DateField_DATE_FIELD_CREATED_AT
+				case "imported":
+					query.By = arkv1.DateField_DATE_FIELD_IMPORTED_AT
+				default:
+					return fmt.Errorf("invalid value for flag %q: %v", byFlag, c.String(byFlag))
+				}
+
+				client, err := newClient()
+				if err != nil {
+					return err
+				}
+
+				return lister.NewLister(client, 100).List(context.Background(), query, c.String(formatFlag), os.Stdout)
+			},
+		},
+		{
+			Name:      "download",
+			Usage:     "Downloads archived files, given their (hex-encoded) hashes",
+			ArgsUsage: "hash [hash...]",
+			Flags: []cli.Flag{
+				&cli.PathFlag{
+					Name:     toFlag,
+					Required: true,
+					Usage:    "Path of the directory the files will be downloaded to.",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return errors.New("expected at least one hash")
+				}
+
+				hashes := make([][]byte, c.NArg())
+				for i, arg := range c.Args().Slice() {
+					hash, err := hex.DecodeString(arg)
+					if err != nil {
+						return fmt.Errorf("invalid hash %v: %w", arg, err)
+					}
+					hashes[i] = hash
+				}
+
+				dest, err := homedir.Expand(c.String(toFlag))
+				if err != nil {
+					return err
+				}
+
+				client, err := newClient()
+				if err != nil {
+					return err
+				}
+
+				return downloader.NewDownloader(client, log).Download(context.Background(), dest, hashes)
 			},
 		},
 	}
 
 	app.Action = func(c *cli.Context) error {
+		if !c.IsSet(fromFlag) {
+			return fmt.Errorf("required flag %q not set", fromFlag)
+		}
+
 		source, err := homedir.Expand(c.String(fromFlag))
 		if err != nil {
 			return err
 		}
 
+		client, err := newClient()
+		if err != nil {
+			return err
+		}
+
+		walkOptions := []fs.WalkOption{
+			fs.WithHashers(cfg.Pipeline.Hashers),
+			fs.WithQueueSize(cfg.Pipeline.HashQueueSize),
+		}
+		if cfg.HashCacheFile != "" {
+			cache, err := openHashCache()
+			if err != nil {
+				return err
+			}
+			walkOptions = append(walkOptions, fs.WithHashCache(cache))
+
+			// keep the hashes computed so far, even if the import fails
+			defer func() {
+				if err := cache.Save(); err != nil {
+					log.Warn("Unable to save hash cache", zap.Error(err))
+				}
+			}()
+		}
+
+		options := []importer.Option{
+			importer.WithWalkOptions(walkOptions...),
+			importer.WithSenders(cfg.Pipeline.Senders),
+			importer.WithQueueSize(cfg.Pipeline.UploadQueueSize),
+			importer.WithRetryPolicy(importer.RetryPolicy{
+				MaxRetries:     cfg.Retries.Max,
+				InitialBackoff: cfg.Retries.InitialBackoff,
+				MaxBackoff:     cfg.Retries.MaxBackoff,
+			}),
+		}
+		if c.Bool(continueOnErrorFlag) {
+			options = append(options, importer.WithContinueOnError())
+		}
+
+		imp := importer.NewImporter(client, cfg.FileTypes, log, options...)
+
+		if c.Bool(dryRunFlag) {
+			plan, err := imp.Plan(context.Background(), source)
+			if err != nil {
+				return err
+			}
+
+			if err := importer.WritePlan(os.Stdout, plan, c.String(formatFlag)); err != nil {
+				return err
+			}
+
+			if len(plan.Failures) > 0 {
+				return fmt.Errorf("unable to plan the import of %d files", len(plan.Failures))
+			}
+
+			return nil
+		}
+
 		now := time.Now()
 		defer func() {
 			log.Info("Import finished", zap.Duration("elapsed_time", time.Since(now)))
 		}()
 
-		serverURL := url.URL{
-			Scheme: cfg.Server.Protocol,
-			Host:   cfg.Server.Address,
-		}
-
-		log.Info("Importing files", zap.String("source_path", source), zap.String("server_url", serverURL.String()))
+		log.Info("Importing files", zap.String("source_path", source), zap.String("server_url", serverURL(cfg)))
 
-		interceptor, err := auth.NewInterceptor([]byte(cfg.SigningKey))
+		summary, err := imp.Import(context.Background(), source)
 		if err != nil {
 			return err
 		}
-		imp := importer.NewImporter(
-			arkv1connect.NewArkApiClient(
-				http.DefaultClient,
-				serverURL.String(),
-				connect.WithSendGzip(),
-				connect.WithInterceptors(interceptor),
-			),
-			cfg.FileTypes,
-			log,
+
+		for _, f := range summary.Failures {
+			log.Error("Failed to import file", zap.String("path", f.Path), zap.String("stage", f.Stage), zap.Error(f.Err))
+		}
+
+		log.Info("Import summary",
+			zap.Int("imported", summary.Imported),
+			zap.Int("duplicates", summary.Duplicates),
+			zap.Int("retries", summary.Retries),
+			zap.Int("failures", len(summary.Failures)),
 		)
 
-		return imp.Import(context.Background(), source)
+		if len(summary.Failures) > 0 {
+			return fmt.Errorf("unable to import %d files", len(summary.Failures))
+		}
+
+		return nil
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal("unable to run application", zap.Error(err))
 	}
 }
+
+func newInterceptor(cfg Config) (*auth.Interceptor, error) {
+	if cfg.PrivateKeyFile != "" {
+		path, err := homedir.Expand(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := auth.LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return auth.NewClientInterceptor(cfg.KeyID, key, cfg.Scopes, cfg.TokenLifetime)
+	}
+
+	if cfg.SigningKey == "" {
+		return nil, errors.New("either a signing key or a private key file is required (or enroll this client first)")
+	}
+
+	subject := cfg.Subject
+	if subject == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			return nil, fmt.Errorf("unable to name this client after its host name, please set a subject: %v", err)
+		}
+		subject = hostname
+	}
+
+	return auth.NewInterceptor([]byte(cfg.SigningKey), auth.Identity{Subject: subject, Scopes: cfg.Scopes}, cfg.TokenLifetime)
+}
+
+// newHTTPClient returns the HTTP client to talk to the server with: over https, it trusts the configured CA bundle and
+// presents the configured client certificate, if any.
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	if cfg.Server.Protocol != "https" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig, err := tlsconfig.NewClientConfig(cfg.Server.TLS.CAFile, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func serverURL(cfg Config) string {
+	u := url.URL{
+		Scheme: cfg.Server.Protocol,
+		Host:   cfg.Server.Address,
+	}
+
+	return u.String()
+}
+
+func writeCachedHashes(w io.Writer, entries []fs.CachedHash, format string) error {
+	switch format {
+	case lister.FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(tw, "HASH\tPATH\tSIZE\tMODIFIED AT"); err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if _, err := fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", hex.EncodeToString(e.Hash), e.Path, e.Size, e.ModTime.Format(time.RFC3339)); err != nil {
+				return err
+			}
+		}
+
+		return tw.Flush()
+	case lister.FormatJSON:
+		type item struct {
+			Hash    string    `json:"hash"`
+			Path    string    `json:"path"`
+			Size    int64     `json:"size"`
+			ModTime time.Time `json:"mod_time"`
+		}
+
+		items := make([]item, len(entries))
+		for i, e := range entries {
+			items[i] = item{Hash: hex.EncodeToString(e.Hash), Path: e.Path, Size: e.Size, ModTime: e.ModTime}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	default:
+		return fmt.Errorf("unknown format: %v", format)
+	}
+}
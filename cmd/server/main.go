@@ -3,16 +3,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
 	"github.com/fedragon/ark/internal/auth"
 	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/indexer"
+	"github.com/fedragon/ark/internal/layout"
+	"github.com/fedragon/ark/internal/limits"
+	"github.com/fedragon/ark/internal/scrubber"
 	"github.com/fedragon/ark/internal/server"
+	"github.com/fedragon/ark/internal/tlsconfig"
 
 	"connectrpc.com/connect"
 	"github.com/kelseyhightower/envconfig"
@@ -20,21 +30,60 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
 )
 
 type Config struct {
 	ArchivePath string `split_words:"true" required:"true"`
-	SigningKey  string `split_words:"true" required:"true"`
-	Address     string `split_words:"true" default:"0.0.0.0:9999"`
-	Redis       struct {
+	// SigningKey verifies the tokens signed with HS256, PublicKeysDir holds the keys that verify the ones signed with
+	// EdDSA or RS256: at least one of them is required
+	SigningKey    string `split_words:"true"`
+	PublicKeysDir string `split_words:"true"`
+	// Admins are the subjects (i.e. client names) that are granted the admin scope
+	Admins           []string
+	Address          string        `split_words:"true" default:"0.0.0.0:9999"`
+	UploadSessionTTL time.Duration `split_words:"true" default:"24h"`
+	Layout           string        `default:"{year}/{month}/{day}"`
+	FileTypes        []string      `split_words:"true" default:"cr2,orf,heic,jpg,jpeg,png,tiff,mp4,mov,avi,mpg,mpeg,wmv"`
+	ShutdownTimeout  time.Duration `split_words:"true" default:"30s"`
+	// EnrollmentCodeTTL is how long enrollment codes are valid for
+	EnrollmentCodeTTL time.Duration `split_words:"true" default:"15m"`
+	TLS               struct {
+		CertFile     string `split_words:"true"`
+		KeyFile      string `split_words:"true"`
+		ClientCAFile string `split_words:"true"`
+	}
+	// Limits apply to the uploads of each client separately: zero means unlimited
+	Limits struct {
+		MaxConcurrentUploads int   `split_words:"true"`
+		BytesPerSecond       int64 `split_words:"true"`
+		Quota                int64
+	}
+	Staging struct {
+		MaxAge        time.Duration `split_words:"true" default:"24h"`
+		SweepInterval time.Duration `split_words:"true" default:"1h"`
+	}
+	Redis struct {
 		Address  string `default:"localhost:6379"`
 		Password string `default:""`
 		Database int    `default:"0"`
 	}
 }
 
+const (
+	// rebuildIndexCommand repopulates the repository from the files in the archive, e.g. after losing the Redis volume.
+	rebuildIndexCommand = "rebuild-index"
+	// scrubCommand checks that all archived files still exist and still match their hash.
+	scrubCommand = "scrub"
+	// revokeCommand adds a client to the revocation list, unrevokeCommand removes it.
+	revokeCommand   = "revoke"
+	unrevokeCommand = "unrevoke"
+	// enrollCommand creates a code that a new client can enroll with, i.e. register its own public key.
+	enrollCommand = "enroll"
+)
+
+// rollbackTimeout is how much of the shutdown timeout is kept for cancelled uploads to roll back (at most half of it)
+const rollbackTimeout = 5 * time.Second
+
 func main() {
 	log, _ := zap.NewProduction()
 	defer log.Sync()
@@ -44,11 +93,24 @@ func main() {
 		log.Fatal("Unable to process config", zap.Error(err))
 	}
 
+	// refuse to start with a partial TLS configuration, rather than silently serving without TLS
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		log.Fatal("Invalid TLS config: both certificate and key files are required")
+	}
+	if cfg.TLS.ClientCAFile != "" && cfg.TLS.CertFile == "" {
+		log.Fatal("Invalid TLS config: mutual TLS requires certificate and key files")
+	}
+
 	archivePath, err := homedir.Expand(cfg.ArchivePath)
 	if err != nil {
 		log.Fatal("Unable to expand home dir", zap.Error(err))
 	}
 
+	archiveLayout, err := layout.Parse(cfg.Layout)
+	if err != nil {
+		log.Fatal("Invalid archive layout", zap.Error(err))
+	}
+
 	client := redis.NewClient(&redis.Options{
 		Addr:     cfg.Redis.Address,
 		Password: cfg.Redis.Password,
@@ -57,20 +119,68 @@ func main() {
 	repo := db.NewRepository(client)
 	defer repo.Close()
 
+	keys, err := auth.NewKeySet([]byte(cfg.SigningKey), cfg.PublicKeysDir)
+	if err != nil {
+		log.Fatal("Unable to load verification keys", zap.Error(err))
+	}
+
 	handler := &server.Handler{
-		Repo:        repo,
-		ArchivePath: archivePath,
+		Repo:             repo,
+		ArchivePath:      archivePath,
+		Layout:           archiveLayout,
+		UploadSessionTTL: cfg.UploadSessionTTL,
+		Scrubber:         scrubber.NewScrubber(repo, log),
+	}
+	if cfg.PublicKeysDir != "" {
+		handler.Keys = keys
 	}
 
-	mux := http.NewServeMux()
-	interceptor, err := auth.NewInterceptor([]byte(cfg.SigningKey))
-	if err != nil {
-		log.Fatal("Unable to initialize interceptor", zap.Error(err))
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case rebuildIndexCommand:
+			rebuildIndex(log, repo, archivePath, cfg.FileTypes)
+		case scrubCommand:
+			scrub(log, handler.Scrubber)
+		case revokeCommand, unrevokeCommand:
+			if len(os.Args) != 3 {
+				log.Fatal("Expected the subject (i.e. the client name) to " + os.Args[1])
+			}
+			revoke(log, repo, os.Args[2], os.Args[1] == revokeCommand)
+		case enrollCommand:
+			if len(os.Args) < 3 || len(os.Args) > 4 {
+				log.Fatal("Expected the subject (i.e. the client name) to enroll, optionally followed by its comma-separated scopes")
+			}
+			var scopes []string
+			if len(os.Args) == 4 {
+				scopes = strings.Split(os.Args[3], ",")
+			}
+			enroll(log, handler, os.Args[2], scopes, cfg.EnrollmentCodeTTL)
+		default:
+			log.Fatal("Unknown command", zap.String("command", os.Args[1]))
+		}
+		return
+	}
+
+	// admin commands may run next to a live server, so only the server itself touches the staging area: the imports it
+	// finds there were interrupted by its own previous run
+	if err := handler.Recover(context.Background()); err != nil {
+		log.Fatal("Unable to recover interrupted imports", zap.Error(err))
 	}
+
+	sweepStagingArea(log, handler, cfg.Staging.MaxAge)
+	go func() {
+		for range time.Tick(cfg.Staging.SweepInterval) {
+			sweepStagingArea(log, handler, cfg.Staging.MaxAge)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	interceptor := auth.NewServerInterceptor(keys, repo, cfg.Admins)
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.Handle(arkv1connect.NewArkApiHandler(
 		handler,
-		connect.WithInterceptors(interceptor),
+		// limits are enforced per client, which must have been authenticated first
+		connect.WithInterceptors(interceptor, limits.NewInterceptor(limits.Limits(cfg.Limits), repo)),
 	))
 
 	listener, err := net.Listen("tcp", cfg.Address)
@@ -78,24 +188,128 @@ func main() {
 		log.Fatal("Unable to listen", zap.Error(err))
 	}
 
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+
+	srv := &http.Server{
+		Handler:   mux,
+		Protocols: protocols,
+	}
+
+	if cfg.TLS.CertFile != "" {
+		srv.TLSConfig, err = tlsconfig.NewServerConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatal("Unable to configure TLS", zap.Error(err))
+		}
+		protocols.SetHTTP2(true)
+	} else {
+		// serve HTTP/2 without TLS
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	drained := make(chan struct{})
 	go func() {
+		defer close(drained)
+
 		<-shutdown
-		log.Info("... Shutting down")
-		close(shutdown)
-		listener.Close()
-		repo.Close()
-		log.Sync()
-		os.Exit(0)
+		log.Info("... Shutting down", zap.Duration("timeout", cfg.ShutdownTimeout))
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		// stop accepting new requests and wait for the active ones to complete, leaving some time for the ones that
+		// do not to roll back
+		requestsCtx, cancelRequests := context.WithTimeout(ctx, max(cfg.ShutdownTimeout-rollbackTimeout, cfg.ShutdownTimeout/2))
+		defer cancelRequests()
+
+		if err := srv.Shutdown(requestsCtx); err != nil {
+			log.Warn("Timed out waiting for active requests, cancelling them", zap.Error(err))
+			_ = srv.Close()
+		}
+
+		// cancelled uploads still need to roll back, which requires the repository: whatever they leave behind is
+		// recovered (or swept) on the next start
+		if err := handler.WaitForUploads(ctx); err != nil {
+			log.Warn("Timed out waiting for cancelled uploads to roll back", zap.Error(err))
+		}
 	}()
 
-	log.Info("... Listening on", zap.String("address", cfg.Address))
-	if err := http.Serve(
-		listener,
-		h2c.NewHandler(mux, &http2.Server{}), // Use h2c so we can serve HTTP/2 without TLS.
-	); err != nil {
+	log.Info("... Listening on", zap.String("address", cfg.Address), zap.Bool("tls", srv.TLSConfig != nil), zap.Bool("mutual_tls", srv.TLSConfig != nil && srv.TLSConfig.ClientCAs != nil))
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("Unable to start HTTP server", zap.Error(err))
 	}
+
+	<-drained
+	log.Info("... Shut down")
+}
+
+func rebuildIndex(log *zap.Logger, repo db.Repository, archivePath string, fileTypes []string) {
+	log.Info("... Rebuilding index", zap.String("archive_path", archivePath))
+
+	report, err := indexer.NewIndexer(repo, fileTypes, log).Rebuild(context.Background(), archivePath)
+	if err != nil {
+		log.Fatal("Unable to rebuild index", zap.Error(err))
+	}
+
+	log.Info("... Index rebuilt",
+		zap.Int("indexed", report.Indexed),
+		zap.Int("unchanged", report.Unchanged),
+		zap.Int("conflicts", len(report.Conflicts)),
+	)
+}
+
+func scrub(log *zap.Logger, s scrubber.Scrubber) {
+	log.Info("... Scrubbing archive")
+
+	report, err := s.Scrub(context.Background())
+	if err != nil {
+		log.Fatal("Unable to scrub archive", zap.Error(err))
+	}
+
+	if len(report.Missing)+len(report.Truncated)+len(report.Corrupted) > 0 {
+		log.Fatal("Found damaged files", zap.Int("checked", report.Checked))
+	}
+}
+
+func sweepStagingArea(log *zap.Logger, handler *server.Handler, maxAge time.Duration) {
+	reclaimed, err := handler.SweepStagingArea(maxAge)
+	if err != nil {
+		log.Error("Unable to sweep staging area", zap.Error(err))
+	}
+
+	if reclaimed > 0 {
+		log.Info("Swept staging area", zap.Int64("reclaimed_bytes", reclaimed))
+	}
+}
+
+func revoke(log *zap.Logger, repo db.Repository, subject string, revoked bool) {
+	var err error
+	if revoked {
+		err = repo.Revoke(context.Background(), subject)
+	} else {
+		err = repo.Unrevoke(context.Background(), subject)
+	}
+	if err != nil {
+		log.Fatal("Unable to update revocation list", zap.Error(err))
+	}
+
+	log.Info("... Updated revocation list", zap.String("subject", subject), zap.Bool("revoked", revoked))
+}
+
+func enroll(log *zap.Logger, handler *server.Handler, subject string, scopes []string, ttl time.Duration) {
+	code, err := handler.NewEnrollment(context.Background(), subject, scopes, ttl)
+	if err != nil {
+		log.Fatal("Unable to create enrollment code", zap.Error(err))
+	}
+
+	log.Info("... Created enrollment code", zap.String("subject", subject), zap.Duration("valid_for", ttl))
+	fmt.Println(code)
 }
@@ -33,19 +33,49 @@ const (
 // reflection-formatted method names, remove the leading slash and convert the remaining slash to a
 // period.
 const (
+	// ArkApiFindDuplicatesProcedure is the fully-qualified name of the ArkApi's FindDuplicates RPC.
+	ArkApiFindDuplicatesProcedure = "/ark.v1.ArkApi/FindDuplicates"
+	// ArkApiOpenUploadSessionProcedure is the fully-qualified name of the ArkApi's OpenUploadSession
+	// RPC.
+	ArkApiOpenUploadSessionProcedure = "/ark.v1.ArkApi/OpenUploadSession"
 	// ArkApiUploadFileProcedure is the fully-qualified name of the ArkApi's UploadFile RPC.
 	ArkApiUploadFileProcedure = "/ark.v1.ArkApi/UploadFile"
+	// ArkApiDownloadFileProcedure is the fully-qualified name of the ArkApi's DownloadFile RPC.
+	ArkApiDownloadFileProcedure = "/ark.v1.ArkApi/DownloadFile"
+	// ArkApiListMediaProcedure is the fully-qualified name of the ArkApi's ListMedia RPC.
+	ArkApiListMediaProcedure = "/ark.v1.ArkApi/ListMedia"
+	// ArkApiScrubArchiveProcedure is the fully-qualified name of the ArkApi's ScrubArchive RPC.
+	ArkApiScrubArchiveProcedure = "/ark.v1.ArkApi/ScrubArchive"
+	// ArkApiGetLayoutProcedure is the fully-qualified name of the ArkApi's GetLayout RPC.
+	ArkApiGetLayoutProcedure = "/ark.v1.ArkApi/GetLayout"
+	// ArkApiEnrollProcedure is the fully-qualified name of the ArkApi's Enroll RPC.
+	ArkApiEnrollProcedure = "/ark.v1.ArkApi/Enroll"
 )
 
 // These variables are the protoreflect.Descriptor objects for the RPCs defined in this package.
 var (
-	arkApiServiceDescriptor          = v1.File_ark_v1_rpc_proto.Services().ByName("ArkApi")
-	arkApiUploadFileMethodDescriptor = arkApiServiceDescriptor.Methods().ByName("UploadFile")
+	arkApiServiceDescriptor                 = v1.File_ark_v1_rpc_proto.Services().ByName("ArkApi")
+	arkApiFindDuplicatesMethodDescriptor    = arkApiServiceDescriptor.Methods().ByName("FindDuplicates")
+	arkApiOpenUploadSessionMethodDescriptor = arkApiServiceDescriptor.Methods().ByName("OpenUploadSession")
+	arkApiUploadFileMethodDescriptor        = arkApiServiceDescriptor.Methods().ByName("UploadFile")
+	arkApiDownloadFileMethodDescriptor      = arkApiServiceDescriptor.Methods().ByName("DownloadFile")
+	arkApiListMediaMethodDescriptor         = arkApiServiceDescriptor.Methods().ByName("ListMedia")
+	arkApiScrubArchiveMethodDescriptor      = arkApiServiceDescriptor.Methods().ByName("ScrubArchive")
+	arkApiGetLayoutMethodDescriptor         = arkApiServiceDescriptor.Methods().ByName("GetLayout")
+	arkApiEnrollMethodDescriptor            = arkApiServiceDescriptor.Methods().ByName("Enroll")
 )
 
 // ArkApiClient is a client for the ark.v1.ArkApi service.
 type ArkApiClient interface {
+	FindDuplicates(context.Context, *connect.Request[v1.FindDuplicatesRequest]) (*connect.Response[v1.FindDuplicatesResponse], error)
+	OpenUploadSession(context.Context, *connect.Request[v1.OpenUploadSessionRequest]) (*connect.Response[v1.OpenUploadSessionResponse], error)
 	UploadFile(context.Context) *connect.ClientStreamForClient[v1.UploadFileRequest, v1.UploadFileResponse]
+	DownloadFile(context.Context, *connect.Request[v1.DownloadFileRequest]) (*connect.ServerStreamForClient[v1.DownloadFileResponse], error)
+	ListMedia(context.Context, *connect.Request[v1.ListMediaRequest]) (*connect.Response[v1.ListMediaResponse], error)
+	ScrubArchive(context.Context, *connect.Request[v1.ScrubArchiveRequest]) (*connect.Response[v1.ScrubArchiveResponse], error)
+	GetLayout(context.Context, *connect.Request[v1.GetLayoutRequest]) (*connect.Response[v1.GetLayoutResponse], error)
+	// Does not require a token: the enrollment code authenticates the client instead
+	Enroll(context.Context, *connect.Request[v1.EnrollRequest]) (*connect.Response[v1.EnrollResponse], error)
 }
 
 // NewArkApiClient constructs a client for the ark.v1.ArkApi service. By default, it uses the
@@ -58,18 +88,77 @@ type ArkApiClient interface {
 func NewArkApiClient(httpClient connect.HTTPClient, baseURL string, opts ...connect.ClientOption) ArkApiClient {
 	baseURL = strings.TrimRight(baseURL, "/")
 	return &arkApiClient{
+		findDuplicates: connect.NewClient[v1.FindDuplicatesRequest, v1.FindDuplicatesResponse](
+			httpClient,
+			baseURL+ArkApiFindDuplicatesProcedure,
+			connect.WithSchema(arkApiFindDuplicatesMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
+		openUploadSession: connect.NewClient[v1.OpenUploadSessionRequest, v1.OpenUploadSessionResponse](
+			httpClient,
+			baseURL+ArkApiOpenUploadSessionProcedure,
+			connect.WithSchema(arkApiOpenUploadSessionMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
 		uploadFile: connect.NewClient[v1.UploadFileRequest, v1.UploadFileResponse](
 			httpClient,
 			baseURL+ArkApiUploadFileProcedure,
 			connect.WithSchema(arkApiUploadFileMethodDescriptor),
 			connect.WithClientOptions(opts...),
 		),
+		downloadFile: connect.NewClient[v1.DownloadFileRequest, v1.DownloadFileResponse](
+			httpClient,
+			baseURL+ArkApiDownloadFileProcedure,
+			connect.WithSchema(arkApiDownloadFileMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
+		listMedia: connect.NewClient[v1.ListMediaRequest, v1.ListMediaResponse](
+			httpClient,
+			baseURL+ArkApiListMediaProcedure,
+			connect.WithSchema(arkApiListMediaMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
+		scrubArchive: connect.NewClient[v1.ScrubArchiveRequest, v1.ScrubArchiveResponse](
+			httpClient,
+			baseURL+ArkApiScrubArchiveProcedure,
+			connect.WithSchema(arkApiScrubArchiveMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
+		getLayout: connect.NewClient[v1.GetLayoutRequest, v1.GetLayoutResponse](
+			httpClient,
+			baseURL+ArkApiGetLayoutProcedure,
+			connect.WithSchema(arkApiGetLayoutMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
+		enroll: connect.NewClient[v1.EnrollRequest, v1.EnrollResponse](
+			httpClient,
+			baseURL+ArkApiEnrollProcedure,
+			connect.WithSchema(arkApiEnrollMethodDescriptor),
+			connect.WithClientOptions(opts...),
+		),
 	}
 }
 
 // arkApiClient implements ArkApiClient.
 type arkApiClient struct {
-	uploadFile *connect.Client[v1.UploadFileRequest, v1.UploadFileResponse]
+	findDuplicates    *connect.Client[v1.FindDuplicatesRequest, v1.FindDuplicatesResponse]
+	openUploadSession *connect.Client[v1.OpenUploadSessionRequest, v1.OpenUploadSessionResponse]
+	uploadFile        *connect.Client[v1.UploadFileRequest, v1.UploadFileResponse]
+	downloadFile      *connect.Client[v1.DownloadFileRequest, v1.DownloadFileResponse]
+	listMedia         *connect.Client[v1.ListMediaRequest, v1.ListMediaResponse]
+	scrubArchive      *connect.Client[v1.ScrubArchiveRequest, v1.ScrubArchiveResponse]
+	getLayout         *connect.Client[v1.GetLayoutRequest, v1.GetLayoutResponse]
+	enroll            *connect.Client[v1.EnrollRequest, v1.EnrollResponse]
+}
+
+// FindDuplicates calls ark.v1.ArkApi.FindDuplicates.
+func (c *arkApiClient) FindDuplicates(ctx context.Context, req *connect.Request[v1.FindDuplicatesRequest]) (*connect.Response[v1.FindDuplicatesResponse], error) {
+	return c.findDuplicates.CallUnary(ctx, req)
+}
+
+// OpenUploadSession calls ark.v1.ArkApi.OpenUploadSession.
+func (c *arkApiClient) OpenUploadSession(ctx context.Context, req *connect.Request[v1.OpenUploadSessionRequest]) (*connect.Response[v1.OpenUploadSessionResponse], error) {
+	return c.openUploadSession.CallUnary(ctx, req)
 }
 
 // UploadFile calls ark.v1.ArkApi.UploadFile.
@@ -77,9 +166,42 @@ func (c *arkApiClient) UploadFile(ctx context.Context) *connect.ClientStreamForC
 	return c.uploadFile.CallClientStream(ctx)
 }
 
+// DownloadFile calls ark.v1.ArkApi.DownloadFile.
+func (c *arkApiClient) DownloadFile(ctx context.Context, req *connect.Request[v1.DownloadFileRequest]) (*connect.ServerStreamForClient[v1.DownloadFileResponse], error) {
+	return c.downloadFile.CallServerStream(ctx, req)
+}
+
+// ListMedia calls ark.v1.ArkApi.ListMedia.
+func (c *arkApiClient) ListMedia(ctx context.Context, req *connect.Request[v1.ListMediaRequest]) (*connect.Response[v1.ListMediaResponse], error) {
+	return c.listMedia.CallUnary(ctx, req)
+}
+
+// ScrubArchive calls ark.v1.ArkApi.ScrubArchive.
+func (c *arkApiClient) ScrubArchive(ctx context.Context, req *connect.Request[v1.ScrubArchiveRequest]) (*connect.Response[v1.ScrubArchiveResponse], error) {
+	return c.scrubArchive.CallUnary(ctx, req)
+}
+
+// GetLayout calls ark.v1.ArkApi.GetLayout.
+func (c *arkApiClient) GetLayout(ctx context.Context, req *connect.Request[v1.GetLayoutRequest]) (*connect.Response[v1.GetLayoutResponse], error) {
+	return c.getLayout.CallUnary(ctx, req)
+}
+
+// Enroll calls ark.v1.ArkApi.Enroll.
+func (c *arkApiClient) Enroll(ctx context.Context, req *connect.Request[v1.EnrollRequest]) (*connect.Response[v1.EnrollResponse], error) {
+	return c.enroll.CallUnary(ctx, req)
+}
+
 // ArkApiHandler is an implementation of the ark.v1.ArkApi service.
 type ArkApiHandler interface {
+	FindDuplicates(context.Context, *connect.Request[v1.FindDuplicatesRequest]) (*connect.Response[v1.FindDuplicatesResponse], error)
+	OpenUploadSession(context.Context, *connect.Request[v1.OpenUploadSessionRequest]) (*connect.Response[v1.OpenUploadSessionResponse], error)
 	UploadFile(context.Context, *connect.ClientStream[v1.UploadFileRequest]) (*connect.Response[v1.UploadFileResponse], error)
+	DownloadFile(context.Context, *connect.Request[v1.DownloadFileRequest], *connect.ServerStream[v1.DownloadFileResponse]) error
+	ListMedia(context.Context, *connect.Request[v1.ListMediaRequest]) (*connect.Response[v1.ListMediaResponse], error)
+	ScrubArchive(context.Context, *connect.Request[v1.ScrubArchiveRequest]) (*connect.Response[v1.ScrubArchiveResponse], error)
+	GetLayout(context.Context, *connect.Request[v1.GetLayoutRequest]) (*connect.Response[v1.GetLayoutResponse], error)
+	// Does not require a token: the enrollment code authenticates the client instead
+	Enroll(context.Context, *connect.Request[v1.EnrollRequest]) (*connect.Response[v1.EnrollResponse], error)
 }
 
 // NewArkApiHandler builds an HTTP handler from the service implementation. It returns the path on
@@ -88,16 +210,72 @@ type ArkApiHandler interface {
 // By default, handlers support the Connect, gRPC, and gRPC-Web protocols with the binary Protobuf
 // and JSON codecs. They also support gzip compression.
 func NewArkApiHandler(svc ArkApiHandler, opts ...connect.HandlerOption) (string, http.Handler) {
+	arkApiFindDuplicatesHandler := connect.NewUnaryHandler(
+		ArkApiFindDuplicatesProcedure,
+		svc.FindDuplicates,
+		connect.WithSchema(arkApiFindDuplicatesMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
+	arkApiOpenUploadSessionHandler := connect.NewUnaryHandler(
+		ArkApiOpenUploadSessionProcedure,
+		svc.OpenUploadSession,
+		connect.WithSchema(arkApiOpenUploadSessionMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
 	arkApiUploadFileHandler := connect.NewClientStreamHandler(
 		ArkApiUploadFileProcedure,
 		svc.UploadFile,
 		connect.WithSchema(arkApiUploadFileMethodDescriptor),
 		connect.WithHandlerOptions(opts...),
 	)
+	arkApiDownloadFileHandler := connect.NewServerStreamHandler(
+		ArkApiDownloadFileProcedure,
+		svc.DownloadFile,
+		connect.WithSchema(arkApiDownloadFileMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
+	arkApiListMediaHandler := connect.NewUnaryHandler(
+		ArkApiListMediaProcedure,
+		svc.ListMedia,
+		connect.WithSchema(arkApiListMediaMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
+	arkApiScrubArchiveHandler := connect.NewUnaryHandler(
+		ArkApiScrubArchiveProcedure,
+		svc.ScrubArchive,
+		connect.WithSchema(arkApiScrubArchiveMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
+	arkApiGetLayoutHandler := connect.NewUnaryHandler(
+		ArkApiGetLayoutProcedure,
+		svc.GetLayout,
+		connect.WithSchema(arkApiGetLayoutMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
+	arkApiEnrollHandler := connect.NewUnaryHandler(
+		ArkApiEnrollProcedure,
+		svc.Enroll,
+		connect.WithSchema(arkApiEnrollMethodDescriptor),
+		connect.WithHandlerOptions(opts...),
+	)
 	return "/ark.v1.ArkApi/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
+		case ArkApiFindDuplicatesProcedure:
+			arkApiFindDuplicatesHandler.ServeHTTP(w, r)
+		case ArkApiOpenUploadSessionProcedure:
+			arkApiOpenUploadSessionHandler.ServeHTTP(w, r)
 		case ArkApiUploadFileProcedure:
 			arkApiUploadFileHandler.ServeHTTP(w, r)
+		case ArkApiDownloadFileProcedure:
+			arkApiDownloadFileHandler.ServeHTTP(w, r)
+		case ArkApiListMediaProcedure:
+			arkApiListMediaHandler.ServeHTTP(w, r)
+		case ArkApiScrubArchiveProcedure:
+			arkApiScrubArchiveHandler.ServeHTTP(w, r)
+		case ArkApiGetLayoutProcedure:
+			arkApiGetLayoutHandler.ServeHTTP(w, r)
+		case ArkApiEnrollProcedure:
+			arkApiEnrollHandler.ServeHTTP(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -107,6 +285,34 @@ func NewArkApiHandler(svc ArkApiHandler, opts ...connect.HandlerOption) (string,
 // UnimplementedArkApiHandler returns CodeUnimplemented from all methods.
 type UnimplementedArkApiHandler struct{}
 
+func (UnimplementedArkApiHandler) FindDuplicates(context.Context, *connect.Request[v1.FindDuplicatesRequest]) (*connect.Response[v1.FindDuplicatesResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.FindDuplicates is not implemented"))
+}
+
+func (UnimplementedArkApiHandler) OpenUploadSession(context.Context, *connect.Request[v1.OpenUploadSessionRequest]) (*connect.Response[v1.OpenUploadSessionResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.OpenUploadSession is not implemented"))
+}
+
 func (UnimplementedArkApiHandler) UploadFile(context.Context, *connect.ClientStream[v1.UploadFileRequest]) (*connect.Response[v1.UploadFileResponse], error) {
 	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.UploadFile is not implemented"))
 }
+
+func (UnimplementedArkApiHandler) DownloadFile(context.Context, *connect.Request[v1.DownloadFileRequest], *connect.ServerStream[v1.DownloadFileResponse]) error {
+	return connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.DownloadFile is not implemented"))
+}
+
+func (UnimplementedArkApiHandler) ListMedia(context.Context, *connect.Request[v1.ListMediaRequest]) (*connect.Response[v1.ListMediaResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.ListMedia is not implemented"))
+}
+
+func (UnimplementedArkApiHandler) ScrubArchive(context.Context, *connect.Request[v1.ScrubArchiveRequest]) (*connect.Response[v1.ScrubArchiveResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.ScrubArchive is not implemented"))
+}
+
+func (UnimplementedArkApiHandler) GetLayout(context.Context, *connect.Request[v1.GetLayoutRequest]) (*connect.Response[v1.GetLayoutResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.GetLayout is not implemented"))
+}
+
+func (UnimplementedArkApiHandler) Enroll(context.Context, *connect.Request[v1.EnrollRequest]) (*connect.Response[v1.EnrollResponse], error) {
+	return nil, connect.NewError(connect.CodeUnimplemented, errors.New("ark.v1.ArkApi.Enroll is not implemented"))
+}
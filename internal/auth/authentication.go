@@ -2,8 +2,12 @@ package auth
 
 import (
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"connectrpc.com/connect"
@@ -15,81 +19,199 @@ const (
 	tokenIssuer = "ark-client"
 )
 
-var errNoToken = errors.New("no token provided")
+const defaultTokenLifetime = 24 * time.Hour
 
+var (
+	errNoToken      = errors.New("no token provided")
+	errTokenExpired = errors.New("token expired")
+)
+
+// claims are the claims of the tokens minted by clients.
+type claims struct {
+	jwt.RegisteredClaims
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Interceptor adds a signed token to the requests of clients and verifies it on the server side, making the identity of
+// the client available to handlers through FromContext.
 type Interceptor struct {
-	key         []byte
-	signedToken string
+	keys        *KeySet
+	revocations Revocations
+	admins      []string
+	signer      *signer
+}
+
+// NewInterceptor returns an interceptor that both signs and verifies tokens with the given HMAC key (HS256): clients
+// and server must share it, so the identity of the client can not really be verified. Tokens are valid for the given
+// lifetime (24 hours if zero) and renewed before they expire.
+func NewInterceptor(signingKey []byte, id Identity, lifetime time.Duration) (*Interceptor, error) {
+	s, err := newSigner(jwt.SigningMethodHS256, "", signingKey, id, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Interceptor{keys: &KeySet{hmacKey: signingKey}, signer: s}, nil
 }
 
-func NewInterceptor(signingKey []byte) (*Interceptor, error) {
-	claims := &jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
-		Issuer:    tokenIssuer,
+// NewClientInterceptor returns a client interceptor that signs tokens with the given private key, either Ed25519
+// (EdDSA) or RSA (RS256): keyID identifies the public key the server has to verify them with, as well as the client
+// itself (i.e. it is the subject of the tokens). Tokens are valid for the given lifetime (24 hours if zero) and renewed
+// before they expire.
+func NewClientInterceptor(keyID string, privateKey crypto.Signer, scopes []string, lifetime time.Duration) (*Interceptor, error) {
+	if keyID == "" {
+		return nil, errors.New("key id is required")
+	}
+
+	var method jwt.SigningMethod
+	switch privateKey.(type) {
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", privateKey)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(signingKey)
+	s, err := newSigner(method, keyID, privateKey, Identity{Subject: keyID, Scopes: scopes}, lifetime)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Interceptor{key: signingKey, signedToken: signedToken}, nil
+	return &Interceptor{signer: s}, nil
 }
 
-func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
-	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
-		if req.Spec().IsClient {
-			req.Header().Set(tokenHeader, i.signedToken)
-			return next(ctx, req)
-		}
+// NewServerInterceptor returns a server interceptor that verifies tokens with the given keys, rejecting the ones of
+// revoked clients (if revocations is not nil) and the ones lacking the scope required by the procedure being called.
+// Only the given admins are ever granted ScopeAdmin.
+func NewServerInterceptor(keys *KeySet, revocations Revocations, admins []string) *Interceptor {
+	return &Interceptor{keys: keys, revocations: revocations, admins: admins}
+}
 
-		tokenString := req.Header().Get(tokenHeader)
-		if tokenString == "" {
-			return nil, connect.NewError(connect.CodeUnauthenticated, errNoToken)
-		}
+// signer signs tokens on behalf of a client, renewing them once most of their lifetime has elapsed.
+type signer struct {
+	method   jwt.SigningMethod
+	keyID    string
+	key      any
+	identity Identity
+	lifetime time.Duration
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unexpected signing method: %v", token.Header["alg"]))
-			}
+	mu       sync.Mutex
+	token    string
+	renewsAt time.Time
+}
 
-			expiry, err := token.Claims.GetExpirationTime()
+func newSigner(method jwt.SigningMethod, keyID string, key any, id Identity, lifetime time.Duration) (*signer, error) {
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+
+	s := &signer{
+		method:   method,
+		keyID:    keyID,
+		key:      key,
+		identity: id,
+		lifetime: lifetime,
+	}
+
+	// fail early if the key cannot sign tokens
+	if _, err := s.get(false); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// get returns the current token, signing a new one if it is about to expire or if renew is true.
+func (s *signer) get(renew bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !renew && s.token != "" && now.Before(s.renewsAt) {
+		return s.token, nil
+	}
+
+	claims := &claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.lifetime)),
+			Issuer:    tokenIssuer,
+			Subject:   s.identity.Subject,
+		},
+		Scopes: s.identity.Scopes,
+	}
+
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.keyID != "" {
+		token.Header["kid"] = s.keyID
+	}
+
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = signed
+	// leave some leeway for long requests and clock skew
+	s.renewsAt = now.Add(s.lifetime - s.lifetime/10)
+
+	return s.token, nil
+}
+
+// isTokenExpired reports whether the server rejected a request because its token had expired.
+func isTokenExpired(err error) bool {
+	var cerr *connect.Error
+	return errors.As(err, &cerr) && cerr.Code() == connect.CodeUnauthenticated && cerr.Message() == errTokenExpired.Error()
+}
+
+func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient {
+			token, err := i.signer.get(false)
 			if err != nil {
-				return nil, connect.NewError(connect.CodeInternal, errors.New("error getting expiration time claim"))
+				return nil, connect.NewError(connect.CodeInternal, err)
 			}
 
-			if expiry.Before(time.Now()) {
-				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("token expired"))
+			req.Header().Set(tokenHeader, token)
+			res, err := next(ctx, req)
+			if !isTokenExpired(err) {
+				return res, err
 			}
 
-			issuer, err := token.Claims.GetIssuer()
-			if err != nil {
-				return nil, connect.NewError(connect.CodeInternal, errors.New("error getting issuer claim"))
+			// e.g. the clocks of client and server are out of sync: retry once with a brand-new token
+			if token, err = i.signer.get(true); err != nil {
+				return nil, connect.NewError(connect.CodeInternal, err)
 			}
 
-			if issuer != tokenIssuer {
-				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid issuer"))
-			}
+			req.Header().Set(tokenHeader, token)
+			return next(ctx, req)
+		}
+
+		if publicProcedures[req.Spec().Procedure] {
+			return next(ctx, req)
+		}
 
-			return i.key, nil
-		})
+		id, err := i.verify(req.Header().Get(tokenHeader))
 		if err != nil {
 			return nil, err
 		}
 
-		if !token.Valid {
-			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid token"))
+		if err := i.authorize(ctx, req.Spec().Procedure, *id); err != nil {
+			return nil, err
 		}
 
-		return next(ctx, req)
+		return next(NewContext(ctx, *id), req)
 	}
 }
 
 func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
 	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
 		conn := next(ctx, spec)
-		conn.RequestHeader().Set(tokenHeader, i.signedToken)
+
+		// streams cannot be retried, since their messages are not kept around: a token about to expire is renewed
+		// before the stream starts, though
+		if token, err := i.signer.get(false); err == nil {
+			conn.RequestHeader().Set(tokenHeader, token)
+		}
 
 		return conn
 	}
@@ -97,44 +219,90 @@ func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) conn
 
 func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
 	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
-		tokenString := conn.RequestHeader().Get(tokenHeader)
-		if tokenString == "" {
-			return connect.NewError(connect.CodeUnauthenticated, errNoToken)
+		if publicProcedures[conn.Spec().Procedure] {
+			return next(ctx, conn)
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unexpected signing method: %v", token.Header["alg"]))
-			}
+		id, err := i.verify(conn.RequestHeader().Get(tokenHeader))
+		if err != nil {
+			return err
+		}
 
-			expiry, err := token.Claims.GetExpirationTime()
-			if err != nil {
-				return nil, connect.NewError(connect.CodeInternal, errors.New("error getting expiration time claim"))
-			}
+		if err := i.authorize(ctx, conn.Spec().Procedure, *id); err != nil {
+			return err
+		}
 
-			if expiry.Before(time.Now()) {
-				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("token expired"))
-			}
+		return next(NewContext(ctx, *id), conn)
+	}
+}
 
-			issuer, err := token.Claims.GetIssuer()
-			if err != nil {
-				return nil, connect.NewError(connect.CodeInternal, errors.New("error getting issuer claim"))
-			}
+// verify verifies the token, returning the identity of the client it has been minted by.
+func (i *Interceptor) verify(tokenString string) (*Identity, error) {
+	if tokenString == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errNoToken)
+	}
 
-			if issuer != tokenIssuer {
-				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid issuer"))
-			}
+	var c claims
+	token, err := jwt.ParseWithClaims(tokenString, &c, func(token *jwt.Token) (interface{}, error) {
+		key, err := i.keys.verificationKey(token)
+		if err != nil {
+			return nil, err
+		}
+
+		expiry, err := token.Claims.GetExpirationTime()
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, errors.New("error getting expiration time claim"))
+		}
+
+		if expiry == nil {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("missing expiration time claim"))
+		}
 
-			return i.key, nil
-		})
+		if expiry.Before(time.Now()) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errTokenExpired)
+		}
+
+		issuer, err := token.Claims.GetIssuer()
 		if err != nil {
-			return connect.NewError(connect.CodeUnauthenticated, err)
+			return nil, connect.NewError(connect.CodeInternal, errors.New("error getting issuer claim"))
 		}
 
-		if !token.Valid {
-			return connect.NewError(connect.CodeUnauthenticated, errors.New("invalid token"))
+		if issuer != tokenIssuer {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid issuer"))
 		}
 
-		return next(ctx, conn)
+		// the key identifies the client: it can not mint tokens on behalf of others
+		if keyID, _ := token.Header["kid"].(string); keyID != "" && c.Subject != keyID {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("subject does not match key id"))
+		}
+
+		return key, nil
+	})
+	if err != nil {
+		var cerr *connect.Error
+		if errors.As(err, &cerr) {
+			return nil, cerr
+		}
+		return nil, connect.NewError(connect.CodeUnauthenticated, err)
 	}
+
+	if !token.Valid {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid token"))
+	}
+
+	// only tokens signed with a public key are bound to a single client, by its key id
+	_, shared := token.Method.(*jwt.SigningMethodHMAC)
+	if c.Subject == "" {
+		if !shared {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("missing subject"))
+		}
+
+		// minted by an earlier version
+		c.Subject = SharedSubject
+	}
+
+	id := Identity{Subject: c.Subject, OwnKey: !shared}
+	id.Scopes = i.grantedScopes(id, c.Scopes)
+
+	return &id, nil
 }
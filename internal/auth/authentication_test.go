@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePublicKey(t *testing.T, dir, keyID string, key crypto.PublicKey) {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, keyID+".pem"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePublicKey(t, dir, "laptop", edKey.Public())
+	writePublicKey(t, dir, "desktop", rsaKey.Public())
+
+	hmacKey := []byte("supersecret")
+
+	withHMAC, err := NewKeySet(hmacKey, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withoutHMAC, err := NewKeySet(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacClient := func(t *testing.T) *Interceptor {
+		i, err := NewInterceptor(hmacKey, Identity{Subject: "laptop"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	keyClient := func(keyID string, key crypto.Signer) func(t *testing.T) *Interceptor {
+		return func(t *testing.T) *Interceptor {
+			i, err := NewClientInterceptor(keyID, key, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return i
+		}
+	}
+
+	tests := []struct {
+		name    string
+		client  func(t *testing.T) *Interceptor
+		keys    *KeySet
+		wantErr bool
+	}{
+		{name: "HS256", client: hmacClient, keys: withHMAC},
+		{name: "HS256 without signing key", client: hmacClient, keys: withoutHMAC, wantErr: true},
+		{name: "EdDSA", client: keyClient("laptop", edKey), keys: withoutHMAC},
+		{name: "RS256", client: keyClient("desktop", rsaKey), keys: withoutHMAC},
+		{name: "unknown key id", client: keyClient("phone", edKey), keys: withoutHMAC, wantErr: true},
+		{name: "key id of another key", client: keyClient("desktop", edKey), keys: withoutHMAC, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.client(t)
+			_, err := NewServerInterceptor(tt.keys, nil, nil).verify(client.signer.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerify_ReloadsRotatedKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	keys, err := NewKeySet(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServerInterceptor(keys, nil, nil)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientInterceptor("new-key", key, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePublicKey(t, dir, "new-key", key.Public())
+
+	// the key set has just been loaded: it is not reloaded right away
+	if _, err := server.verify(client.signer.token); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	keys.loadedAt = time.Now().Add(-minReloadInterval)
+	if _, err := server.verify(client.signer.token); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "new-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed keys are accepted until the key set is reloaded
+	if _, err := server.verify(client.signer.token); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+
+	keys.loadedAt = time.Now().Add(-maxKeysAge)
+	if _, err := server.verify(client.signer.token); err == nil {
+		t.Fatal("expected an error after the key has been removed")
+	}
+}
+
+func TestKeySet_Register(t *testing.T) {
+	keys, err := NewKeySet(nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServerInterceptor(keys, nil, nil)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientInterceptor("new-laptop", key, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Register("new-laptop", key.Public(), nil); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	// registered keys are accepted straight away, without waiting for the key set to be reloaded
+	if _, err := server.verify(client.signer.token); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+
+	for _, keyID := range []string{"", "../laptop", ".hidden", "a/b"} {
+		if err := keys.Register(keyID, key.Public(), nil); err == nil {
+			t.Errorf("expected an error for key id %q", keyID)
+		}
+	}
+}
+
+func TestSigner_RenewsTokensBeforeTheyExpire(t *testing.T) {
+	client, err := NewInterceptor([]byte("supersecret"), Identity{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := client.signer.get(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := client.signer.get(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Fatal("expected the token to be reused")
+	}
+
+	client.signer.renewsAt = time.Now().Add(-time.Second)
+
+	if _, err := client.signer.get(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !client.signer.renewsAt.After(time.Now()) {
+		t.Fatal("expected the token to be renewed")
+	}
+}
+
+func TestVerify_ReportsExpiredTokens(t *testing.T) {
+	client, err := NewInterceptor([]byte("supersecret"), Identity{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.signer.lifetime = -time.Minute
+	token, err := client.signer.get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.verify(token); !isTokenExpired(err) {
+		t.Fatalf("expected an expired token error, got %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// minReloadInterval limits how often the public keys are reloaded when a token references an unknown key id
+	minReloadInterval = 10 * time.Second
+	// maxKeysAge is how long the public keys are used before being reloaded, so that removed keys stop being accepted
+	maxKeysAge = time.Minute
+)
+
+// keyIDPattern restricts key ids to what can safely be used as a file name
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// KeySet holds the keys the server verifies tokens with: an optional HMAC key, shared with clients signing their
+// tokens with HS256, and the public keys of clients signing their tokens with EdDSA or RS256, selected by the key id
+// ("kid") in the token header.
+//
+// Public keys are read from the PEM files in a directory, each file being named after its key id (e.g. laptop-1.pem):
+// keys are rotated by adding the new key file, switching clients to the new key and finally removing the old key file.
+// The scopes granted to a key, if any, are read from the JSON file next to it (e.g. laptop-1.scopes). The directory is
+// reloaded every minute, and whenever a token references an unknown key id.
+type KeySet struct {
+	hmacKey       []byte
+	publicKeysDir string
+
+	mu         sync.RWMutex
+	publicKeys map[string]crypto.PublicKey
+	scopes     map[string][]string
+	loadedAt   time.Time
+}
+
+// NewKeySet returns the keys to verify tokens with: either one of hmacKey and publicKeysDir may be empty, but not both.
+func NewKeySet(hmacKey []byte, publicKeysDir string) (*KeySet, error) {
+	if len(hmacKey) == 0 && publicKeysDir == "" {
+		return nil, errors.New("either a signing key or a public keys directory is required")
+	}
+
+	ks := &KeySet{
+		hmacKey:       hmacKey,
+		publicKeysDir: publicKeysDir,
+	}
+
+	if publicKeysDir != "" {
+		if err := ks.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) reload() error {
+	publicKeys, scopes, err := loadPublicKeys(ks.publicKeysDir)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.publicKeys = publicKeys
+	ks.scopes = scopes
+	ks.loadedAt = time.Now()
+
+	return nil
+}
+
+// ValidKeyID reports whether keyID can be used to identify a public key (and its client).
+func ValidKeyID(keyID string) bool {
+	return keyIDPattern.MatchString(keyID)
+}
+
+// Register stores the public key of a client together with the scopes it is granted (the default ones if empty),
+// replacing the ones it may already have: tokens signed with the corresponding private key are accepted straight away.
+func (ks *KeySet) Register(keyID string, key crypto.PublicKey, scopes []string) error {
+	if ks.publicKeysDir == "" {
+		return errors.New("no public keys directory")
+	}
+
+	if !ValidKeyID(keyID) {
+		return fmt.Errorf("invalid key id: %v", keyID)
+	}
+
+	data, err := MarshalPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	// the scopes are written first, so that the key is never accepted with the scopes of the one it replaces
+	scopesPath := filepath.Join(ks.publicKeysDir, keyID+".scopes")
+	if len(scopes) == 0 {
+		if err := os.Remove(scopesPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		encoded, err := json.Marshal(scopes)
+		if err != nil {
+			return err
+		}
+
+		if err := ks.writeFile(scopesPath, encoded); err != nil {
+			return err
+		}
+	}
+
+	if err := ks.writeFile(filepath.Join(ks.publicKeysDir, keyID+".pem"), data); err != nil {
+		return err
+	}
+
+	return ks.reload()
+}
+
+// writeFile writes to a temporary file first, so that a partial file is never loaded.
+func (ks *KeySet) writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(ks.publicKeysDir, ".register-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (ks *KeySet) publicKey(keyID string) (crypto.PublicKey, bool) {
+	ks.mu.RLock()
+	key, ok := ks.publicKeys[keyID]
+	loadedAt := ks.loadedAt
+	ks.mu.RUnlock()
+
+	age := time.Since(loadedAt)
+	if (ok && age < maxKeysAge) || (!ok && age < minReloadInterval) {
+		return key, ok
+	}
+
+	// the key may have been added (or removed) after the last reload
+	if err := ks.reload(); err != nil {
+		return nil, false
+	}
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok = ks.publicKeys[keyID]
+	return key, ok
+}
+
+// grantedScopes returns the scopes stored for the key, if any: it must be called after its token has been verified, so
+// that the key set is up-to-date.
+func (ks *KeySet) grantedScopes(keyID string) ([]string, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	scopes, ok := ks.scopes[keyID]
+	return scopes, ok
+}
+
+// verificationKey returns the key to verify the token with, making sure that it matches the signing method of the
+// token (so that, e.g., a public key is never used as an HMAC key).
+func (ks *KeySet) verificationKey(token *jwt.Token) (any, error) {
+	if ks == nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("no verification keys"))
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(ks.hmacKey) == 0 {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unexpected signing method: %v", token.Header["alg"]))
+		}
+
+		return ks.hmacKey, nil
+	}
+
+	keyID, _ := token.Header["kid"].(string)
+	if keyID == "" {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("missing key id"))
+	}
+
+	key, ok := ks.publicKey(keyID)
+	if !ok {
+		return nil, connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("unknown key id: %v", keyID))
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodEd25519:
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodRSA:
+		if token.Method == jwt.SigningMethodRS256 {
+			if _, ok := key.(*rsa.PublicKey); ok {
+				return key, nil
+			}
+		}
+	}
+
+	return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unexpected signing method for key %v: %v", keyID, token.Header["alg"]))
+}
+
+func loadPublicKeys(dir string) (map[string]crypto.PublicKey, map[string][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read public keys directory: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	scopes := make(map[string][]string)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		switch filepath.Ext(e.Name()) {
+		case ".pem":
+			key, err := LoadPublicKey(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			keys[strings.TrimSuffix(e.Name(), ".pem")] = key
+		case ".scopes":
+			data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var s []string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return nil, nil, fmt.Errorf("%v: %w", e.Name(), err)
+			}
+
+			scopes[strings.TrimSuffix(e.Name(), ".scopes")] = s
+		}
+	}
+
+	return keys, scopes, nil
+}
+
+// LoadPublicKey reads an Ed25519 or RSA public key from a PEM file (PKIX, i.e. "BEGIN PUBLIC KEY").
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// ParsePublicKey parses a PEM-encoded Ed25519 or RSA public key (PKIX, i.e. "BEGIN PUBLIC KEY").
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key: %w", err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", key)
+	}
+}
+
+// MarshalPrivateKey PEM-encodes a private key (PKCS #8), so that it can be read back with LoadPrivateKey.
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKey PEM-encodes a public key (PKIX), so that it can be read back with ParsePublicKey.
+func MarshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// LoadPrivateKey reads an Ed25519 or RSA private key from a PEM file (PKCS #8, i.e. "BEGIN PRIVATE KEY", or PKCS #1,
+// i.e. "BEGIN RSA PRIVATE KEY").
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %v: %w", path, err)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type in %v: %T", path, key)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %v", path)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+
+	"connectrpc.com/connect"
+)
+
+const (
+	// ScopeUpload allows importing files into the archive
+	ScopeUpload = "upload"
+	// ScopeRead allows listing and downloading archived files
+	ScopeRead = "read"
+	// ScopeAdmin allows maintaining the archive (e.g. scrubbing it)
+	ScopeAdmin = "admin"
+)
+
+// DefaultScopes are the scopes granted to clients the server holds no scopes for (e.g. the ones sharing the signing key),
+// as well as the ones requested by tokens that do not list any (e.g. the ones minted by earlier versions).
+var DefaultScopes = []string{ScopeUpload, ScopeRead}
+
+// SharedSubject is the subject of the tokens signed with the shared key that do not claim any (e.g. the ones minted by
+// earlier versions): it is not a valid key id, so that it can never be mistaken for a client with its own key.
+const SharedSubject = "(shared key)"
+
+// procedureScopes maps each procedure to the scope it requires: procedures not listed here require ScopeAdmin.
+var procedureScopes = map[string]string{
+	arkv1connect.ArkApiFindDuplicatesProcedure:    ScopeUpload,
+	arkv1connect.ArkApiOpenUploadSessionProcedure: ScopeUpload,
+	arkv1connect.ArkApiUploadFileProcedure:        ScopeUpload,
+	arkv1connect.ArkApiDownloadFileProcedure:      ScopeRead,
+	arkv1connect.ArkApiListMediaProcedure:         ScopeRead,
+	arkv1connect.ArkApiGetLayoutProcedure:         ScopeRead,
+	arkv1connect.ArkApiScrubArchiveProcedure:      ScopeAdmin,
+}
+
+// publicProcedures do not require a token, since they authenticate clients by other means (e.g. enrollment codes).
+var publicProcedures = map[string]bool{
+	arkv1connect.ArkApiEnrollProcedure: true,
+}
+
+// Identity is the client a request has been authenticated as.
+type Identity struct {
+	// Subject is the name of the client (e.g. the name of the device)
+	Subject string
+	Scopes  []string
+	// OwnKey tells whether the token has been verified with the client's own public key, which proves the subject:
+	// tokens signed with the shared key can claim any subject
+	OwnKey bool
+}
+
+// HasScope reports whether the identity has been granted the given scope.
+func (id Identity) HasScope(scope string) bool {
+	return slices.Contains(id.Scopes, scope)
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity.
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity a request has been authenticated as, if any.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// Revocations tells which subjects have been revoked, i.e. must no longer be allowed in.
+type Revocations interface {
+	IsRevoked(ctx context.Context, subject string) (bool, error)
+}
+
+// authorize checks that the identity is allowed to call the procedure.
+func (i *Interceptor) authorize(ctx context.Context, procedure string, id Identity) error {
+	if i.revocations != nil {
+		revoked, err := i.revocations.IsRevoked(ctx, id.Subject)
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+
+		if revoked {
+			return connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("client has been revoked: %v", id.Subject))
+		}
+	}
+
+	required, ok := procedureScopes[procedure]
+	if !ok {
+		required = ScopeAdmin
+	}
+
+	if !id.HasScope(required) {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("missing scope: "+required))
+	}
+
+	return nil
+}
+
+// grantedScopes returns the scopes requested by the token that the server actually grants to the client, i.e. the ones
+// stored for its key (the default ones if none are, or if it shares the signing key). Tokens can only narrow those down,
+// never widen them: ScopeAdmin, in particular, is only ever granted to admins, and only if their token proves who they
+// are.
+func (i *Interceptor) grantedScopes(id Identity, requested []string) []string {
+	if len(requested) == 0 {
+		requested = DefaultScopes
+	}
+
+	grants := DefaultScopes
+	if id.OwnKey {
+		if stored, ok := i.keys.grantedScopes(id.Subject); ok {
+			grants = stored
+		}
+	}
+	admin := id.OwnKey && slices.Contains(i.admins, id.Subject)
+
+	granted := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		if scope == ScopeAdmin {
+			if admin {
+				granted = append(granted, scope)
+			}
+			continue
+		}
+
+		if slices.Contains(grants, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	return granted
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+
+	"connectrpc.com/connect"
+)
+
+type revoked map[string]bool
+
+func (r revoked) IsRevoked(_ context.Context, subject string) (bool, error) {
+	return r[subject], nil
+}
+
+func TestAuthorize(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePublicKey(t, dir, "laptop", key.Public())
+	writePublicKey(t, dir, "nas", key.Public())
+	writePublicKey(t, dir, "lost-phone", key.Public())
+
+	keys, err := NewKeySet([]byte("supersecret"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServerInterceptor(keys, revoked{"lost-phone": true}, []string{"nas"})
+
+	tests := []struct {
+		name      string
+		keyID     string
+		scopes    []string
+		procedure string
+		wantCode  connect.Code
+	}{
+		{name: "default scopes allow uploads", keyID: "laptop", procedure: arkv1connect.ArkApiUploadFileProcedure},
+		{name: "default scopes allow reads", keyID: "laptop", procedure: arkv1connect.ArkApiListMediaProcedure},
+		{name: "default scopes deny admin", keyID: "laptop", procedure: arkv1connect.ArkApiScrubArchiveProcedure, wantCode: connect.CodePermissionDenied},
+		{name: "missing scope", keyID: "laptop", scopes: []string{ScopeRead}, procedure: arkv1connect.ArkApiUploadFileProcedure, wantCode: connect.CodePermissionDenied},
+		{name: "admin scope of non-admin", keyID: "laptop", scopes: []string{ScopeAdmin}, procedure: arkv1connect.ArkApiScrubArchiveProcedure, wantCode: connect.CodePermissionDenied},
+		{name: "admin scope of admin", keyID: "nas", scopes: []string{ScopeAdmin}, procedure: arkv1connect.ArkApiScrubArchiveProcedure},
+		{name: "unknown procedure", keyID: "nas", procedure: "/ark.v1.ArkApi/Unknown", wantCode: connect.CodePermissionDenied},
+		{name: "revoked client", keyID: "lost-phone", procedure: arkv1connect.ArkApiUploadFileProcedure, wantCode: connect.CodeUnauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClientInterceptor(tt.keyID, key, tt.scopes, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := server.verify(client.signer.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id.Subject != tt.keyID {
+				t.Errorf("expected subject %v, got %v", tt.keyID, id.Subject)
+			}
+
+			err = server.authorize(context.Background(), tt.procedure, *id)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Errorf("authorize() error = %v", err)
+				}
+				return
+			}
+
+			var cerr *connect.Error
+			if !errors.As(err, &cerr) || cerr.Code() != tt.wantCode {
+				t.Errorf("expected code %v, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestVerify_RejectsTokensOnBehalfOfOthers(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePublicKey(t, dir, "laptop", key.Public())
+
+	keys, err := NewKeySet(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientInterceptor("laptop", key, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.signer.identity.Subject = "nas"
+	token, err := client.signer.get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewServerInterceptor(keys, nil, nil).verify(token); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestVerify_DoesNotTrustSubjectsOfSharedKeyTokens(t *testing.T) {
+	hmacKey := []byte("supersecret")
+
+	keys, err := NewKeySet(hmacKey, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServerInterceptor(keys, nil, []string{"nas"})
+
+	client, err := NewInterceptor(hmacKey, Identity{Subject: "nas", Scopes: []string{ScopeAdmin}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := server.verify(client.signer.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.OwnKey || id.HasScope(ScopeAdmin) {
+		t.Errorf("expected a shared key token not to be granted admin, got %+v", id)
+	}
+}
+
+func TestVerify_AcceptsLegacyTokens(t *testing.T) {
+	hmacKey := []byte("supersecret")
+
+	keys, err := NewKeySet(hmacKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// earlier versions minted tokens without subject nor scopes
+	legacy, err := NewInterceptor(hmacKey, Identity{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := NewServerInterceptor(keys, nil, []string{SharedSubject}).verify(legacy.signer.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.Subject != SharedSubject || id.OwnKey {
+		t.Errorf("expected the shared subject, got %+v", id)
+	}
+	if !slices.Equal(id.Scopes, DefaultScopes) {
+		t.Errorf("expected the default scopes, got %v", id.Scopes)
+	}
+}
+
+func TestVerify_GrantsStoredScopesOnly(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewKeySet(nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Register("phone", key.Public(), []string{ScopeRead}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServerInterceptor(keys, nil, nil)
+
+	tests := []struct {
+		name      string
+		requested []string
+		want      []string
+	}{
+		{name: "no scopes requested", want: []string{ScopeRead}},
+		{name: "stored scope requested", requested: []string{ScopeRead}, want: []string{ScopeRead}},
+		{name: "other scopes requested", requested: []string{ScopeUpload, ScopeRead, ScopeAdmin}, want: []string{ScopeRead}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClientInterceptor("phone", key, tt.requested, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := server.verify(client.signer.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(id.Scopes, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, id.Scopes)
+			}
+		})
+	}
+}
@@ -2,6 +2,12 @@ package db
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fedragon/ark/internal/metrics"
@@ -9,6 +15,51 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	uploadSessionPrefix = "session:"
+	indexPrefix         = "index:"
+	reservationPrefix   = "reservation:"
+	revokedSubjectsKey  = "revoked-subjects"
+	enrollmentPrefix    = "enrollment:"
+	usagePrefix         = "usage:"
+
+	// scanCount is how many keys are (roughly) examined by each SCAN iteration
+	scanCount = 1000
+)
+
+var (
+	// KEYS[1] is the media key, KEYS[2] the reservation key; ARGV[1] is the owner, ARGV[2] the ttl in milliseconds
+	reserveScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+  return 0
+end
+local owner = redis.call("GET", KEYS[2])
+if owner and owner ~= ARGV[1] then
+  return 1
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+return 2
+`)
+
+	// KEYS[1] is the usage key; ARGV[1] is the number of bytes to reserve, ARGV[2] the quota (unlimited if not positive)
+	reserveUsageScript = redis.NewScript(`
+local used = redis.call("INCRBY", KEYS[1], ARGV[1])
+local quota = tonumber(ARGV[2])
+if quota > 0 and used > quota then
+  return {redis.call("DECRBY", KEYS[1], ARGV[1]), 0}
+end
+return {used, 1}
+`)
+
+	// KEYS[1] is the reservation key; ARGV[1] is the owner
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+)
+
 type redisRepo struct {
 	client *redis.Client
 }
@@ -38,6 +89,324 @@ func (r *redisRepo) Get(ctx context.Context, hash []byte) (*Media, error) {
 		return nil, nil
 	}
 
+	return toMedia(hash, data)
+}
+
+func (r *redisRepo) GetMany(ctx context.Context, hashes [][]byte) ([]Media, error) {
+	now := time.Now()
+	defer func() {
+		metrics.GetManyDurationMs.Observe(float64(time.Since(now).Milliseconds()))
+	}()
+
+	cmds := make([]*redis.MapStringStringCmd, len(hashes))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, hash := range hashes {
+			cmds[i] = pipe.HGetAll(ctx, string(hash))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var media []Media
+	for i, cmd := range cmds {
+		data := cmd.Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		m, err := toMedia(hashes[i], data)
+		if err != nil {
+			return nil, err
+		}
+
+		media = append(media, *m)
+	}
+
+	return media, nil
+}
+
+func (r *redisRepo) Store(ctx context.Context, media Media) error {
+	now := time.Now()
+	defer func() {
+		metrics.StoreDurationMs.Observe(float64(time.Since(now).Milliseconds()))
+	}()
+
+	values := map[string]interface{}{
+		"path":       media.Path,
+		"created_at": media.CreatedAt.Format(time.RFC3339Nano),
+	}
+
+	if media.ImportedAt != nil {
+		values["imported_at"] = media.ImportedAt.Format(time.RFC3339Nano)
+	}
+
+	if media.Size > 0 {
+		values["size"] = media.Size
+	}
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, string(media.Hash), values)
+		pipe.ZAdd(ctx, indexPrefix+string(CreatedAt), redis.Z{Score: score(media.CreatedAt), Member: string(media.Hash)})
+		if media.ImportedAt != nil {
+			pipe.ZAdd(ctx, indexPrefix+string(ImportedAt), redis.Z{Score: score(*media.ImportedAt), Member: string(media.Hash)})
+		}
+		pipe.Del(ctx, reservationPrefix+string(media.Hash))
+		return nil
+	})
+
+	return err
+}
+
+func (r *redisRepo) Index(ctx context.Context, media Media) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, indexPrefix+string(CreatedAt), redis.Z{Score: score(media.CreatedAt), Member: string(media.Hash)})
+		if media.ImportedAt != nil {
+			pipe.HSetNX(ctx, string(media.Hash), "imported_at", media.ImportedAt.Format(time.RFC3339Nano))
+			pipe.ZAdd(ctx, indexPrefix+string(ImportedAt), redis.Z{Score: score(*media.ImportedAt), Member: string(media.Hash)})
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *redisRepo) Reserve(ctx context.Context, hash []byte, owner string, ttl time.Duration) error {
+	keys := []string{string(hash), reservationPrefix + string(hash)}
+	res, err := reserveScript.Run(ctx, r.client, keys, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+
+	switch res {
+	case 0:
+		return ErrAlreadyStored
+	case 1:
+		return ErrAlreadyReserved
+	default:
+		return nil
+	}
+}
+
+func (r *redisRepo) Release(ctx context.Context, hash []byte, owner string) error {
+	return releaseScript.Run(ctx, r.client, []string{reservationPrefix + string(hash)}, owner).Err()
+}
+
+func (r *redisRepo) List(ctx context.Context, query ListQuery) ([]Media, string, error) {
+	now := time.Now()
+	defer func() {
+		metrics.ListDurationMs.Observe(float64(time.Since(now).Milliseconds()))
+	}()
+
+	if query.Limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit: %v", query.Limit)
+	}
+
+	from, to := "-inf", "+inf"
+	if !query.From.IsZero() {
+		from = formatScore(score(query.From))
+	}
+	if !query.To.IsZero() {
+		to = "(" + formatScore(score(query.To))
+	}
+
+	// the cursor holds the score of the last media of the previous page, plus how many media with that same score
+	// have already been returned
+	var cursorScore float64
+	var offset int64
+	if query.Cursor != "" {
+		var err error
+		cursorScore, offset, err = decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		from = formatScore(cursorScore)
+	}
+
+	entries, err := r.client.ZRangeByScoreWithScores(ctx, indexPrefix+string(query.By), &redis.ZRangeBy{
+		Min:    from,
+		Max:    to,
+		Offset: offset,
+		Count:  int64(query.Limit) + 1,
+	}).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var cursor string
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+
+		last := entries[len(entries)-1].Score
+		var skip int64
+		for _, e := range entries {
+			if e.Score == last {
+				skip++
+			}
+		}
+		if query.Cursor != "" && last == cursorScore {
+			skip += offset
+		}
+
+		cursor = encodeCursor(last, skip)
+	}
+
+	hashes := make([][]byte, len(entries))
+	for i, e := range entries {
+		hashes[i] = []byte(e.Member.(string))
+	}
+
+	media, err := r.GetMany(ctx, hashes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return media, cursor, nil
+}
+
+func (r *redisRepo) ForEach(ctx context.Context, fn func(Media) error) error {
+	var cursor uint64
+	for {
+		// media are the only hashes, besides upload sessions
+		keys, next, err := r.client.ScanType(ctx, cursor, "", scanCount, "hash").Result()
+		if err != nil {
+			return err
+		}
+
+		hashes := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			if !strings.HasPrefix(key, uploadSessionPrefix) {
+				hashes = append(hashes, []byte(key))
+			}
+		}
+
+		media, err := r.GetMany(ctx, hashes)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range media {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *redisRepo) Revoke(ctx context.Context, subject string) error {
+	return r.client.SAdd(ctx, revokedSubjectsKey, subject).Err()
+}
+
+func (r *redisRepo) Unrevoke(ctx context.Context, subject string) error {
+	return r.client.SRem(ctx, revokedSubjectsKey, subject).Err()
+}
+
+func (r *redisRepo) IsRevoked(ctx context.Context, subject string) (bool, error) {
+	return r.client.SIsMember(ctx, revokedSubjectsKey, subject).Result()
+}
+
+func (r *redisRepo) AddUsage(ctx context.Context, subject string, bytes int64) error {
+	return r.client.IncrBy(ctx, usagePrefix+subject, bytes).Err()
+}
+
+func (r *redisRepo) ReserveUsage(ctx context.Context, subject string, bytes, quota int64) (int64, bool, error) {
+	res, err := reserveUsageScript.Run(ctx, r.client, []string{usagePrefix + subject}, bytes, quota).Int64Slice()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return res[0], res[1] == 1, nil
+}
+
+func (r *redisRepo) Usage(ctx context.Context, subject string) (int64, error) {
+	usage, err := r.client.Get(ctx, usagePrefix+subject).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+
+	return usage, err
+}
+
+func (r *redisRepo) StoreEnrollment(ctx context.Context, enrollment Enrollment, ttl time.Duration) error {
+	// stored as a string rather than a hash, so that enrollments are never mistaken for media
+	data, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, enrollmentPrefix+enrollment.Code, data, ttl).Err()
+}
+
+func (r *redisRepo) ConsumeEnrollment(ctx context.Context, code string) (*Enrollment, error) {
+	data, err := r.client.GetDel(ctx, enrollmentPrefix+code).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var enrollment Enrollment
+	if err := json.Unmarshal(data, &enrollment); err != nil {
+		return nil, err
+	}
+	enrollment.Code = code
+
+	return &enrollment, nil
+}
+
+func (r *redisRepo) StoreUploadSession(ctx context.Context, session UploadSession, ttl time.Duration) error {
+	key := uploadSessionPrefix + string(session.Hash)
+	values := map[string]interface{}{
+		"id":   session.ID,
+		"name": session.Name,
+		"size": session.Size,
+	}
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, values)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+func (r *redisRepo) GetUploadSession(ctx context.Context, hash []byte) (*UploadSession, error) {
+	data, err := r.client.HGetAll(ctx, uploadSessionPrefix+string(hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	size, err := strconv.ParseInt(data["size"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadSession{
+		ID:   data["id"],
+		Hash: hash,
+		Name: data["name"],
+		Size: size,
+	}, nil
+}
+
+func (r *redisRepo) DeleteUploadSession(ctx context.Context, hash []byte) error {
+	return r.client.Del(ctx, uploadSessionPrefix+string(hash)).Err()
+}
+
+func toMedia(hash []byte, data map[string]string) (*Media, error) {
 	createdAt, err := time.Parse(time.RFC3339Nano, data["created_at"])
 	if err != nil {
 		return nil, err
@@ -53,28 +422,47 @@ func (r *redisRepo) Get(ctx context.Context, hash []byte) (*Media, error) {
 		importedAt = &imported
 	}
 
+	var size int64
+	if s, ok := data["size"]; ok {
+		size, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Media{
 		Hash:       hash,
 		Path:       data["path"],
 		CreatedAt:  createdAt,
 		ImportedAt: importedAt,
+		Size:       size,
 	}, nil
 }
 
-func (r *redisRepo) Store(ctx context.Context, media Media) error {
-	now := time.Now()
-	defer func() {
-		metrics.StoreDurationMs.Observe(float64(time.Since(now).Milliseconds()))
-	}()
+// score returns the score of a date in the sorted sets used as indexes: milliseconds are precise enough, while still
+// fitting in the float64 used by Redis.
+func score(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
 
-	values := map[string]interface{}{
-		"path":       media.Path,
-		"created_at": media.CreatedAt.Format(time.RFC3339Nano),
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func encodeCursor(score float64, skip int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", int64(score), skip)))
+}
+
+func decodeCursor(cursor string) (float64, int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, ErrInvalidCursor
 	}
 
-	if media.ImportedAt != nil {
-		values["imported_at"] = media.ImportedAt.Format(time.RFC3339Nano)
+	var score, skip int64
+	if _, err := fmt.Sscanf(string(decoded), "%d:%d", &score, &skip); err != nil || skip < 0 {
+		return 0, 0, ErrInvalidCursor
 	}
 
-	return r.client.HSet(ctx, string(media.Hash), values).Err()
+	return float64(score), skip, nil
 }
@@ -2,23 +2,124 @@ package db
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+var (
+	// ErrInvalidCursor is returned when listing media with a cursor that was not returned by a previous call to List
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrAlreadyStored is returned when reserving a hash that has already been stored
+	ErrAlreadyStored = errors.New("already stored")
+	// ErrAlreadyReserved is returned when reserving a hash that is currently reserved by someone else
+	ErrAlreadyReserved = errors.New("already reserved")
+)
+
 type Media struct {
 	Hash       []byte     `json:"hash"`
 	Path       string     `json:"path"`
 	CreatedAt  time.Time  `json:"created_at"`
 	ImportedAt *time.Time `json:"imported_at,omitempty"`
-	Err        error      `json:"-"`
+	// Size is the size of the file in bytes, if known (media imported by earlier versions do not record it)
+	Size int64 `json:"size,omitempty"`
+	Err  error `json:"-"`
+}
+
+// UploadSession tracks a resumable upload, whose partial content is kept in the staging area until the session expires
+type UploadSession struct {
+	ID   string
+	Hash []byte
+	Name string
+	Size int64
+}
+
+// Enrollment allows a new client to register its public key once, by presenting its code before it expires
+type Enrollment struct {
+	Code    string   `json:"-"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+// DateField is a date of a media that can be used to list media
+type DateField string
+
+const (
+	CreatedAt  DateField = "created_at"
+	ImportedAt DateField = "imported_at"
+)
+
+// ListQuery selects the media whose date (as per By) falls within [From, To), sorted by that date: a zero From or To
+// leaves the range unbounded on that side. Results are paginated, Cursor being the one returned with the previous page.
+type ListQuery struct {
+	By     DateField
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
 }
 
 type Repository interface {
 	Close() error
 
-	// Store stores a media in the database
+	// Store stores a media in the database, releasing any reservation of its hash
 	Store(ctx context.Context, media Media) error
 
+	// Reserve atomically reserves a hash on behalf of owner, so that nobody else can upload the same content at the
+	// same time: it fails with ErrAlreadyStored or ErrAlreadyReserved if that is not possible. Reserving a hash again
+	// with the same owner extends the reservation, which otherwise expires after ttl.
+	Reserve(ctx context.Context, hash []byte, owner string, ttl time.Duration) error
+
+	// Index adds an already stored media to the date indexes (e.g. if it was stored before they existed), recording
+	// its import date if missing
+	Index(ctx context.Context, media Media) error
+
+	// Release releases the reservation of a hash, provided that it belongs to owner
+	Release(ctx context.Context, hash []byte, owner string) error
+
 	// Get returns a media from the database
 	Get(ctx context.Context, hash []byte) (*Media, error)
+
+	// GetMany returns the media with the given hashes from the database, skipping the ones that do not exist
+	GetMany(ctx context.Context, hashes [][]byte) ([]Media, error)
+
+	// List returns the media selected by the query, together with the cursor of the next page (empty if there are no
+	// more pages)
+	List(ctx context.Context, query ListQuery) ([]Media, string, error)
+
+	// ForEach calls fn with every media in the database, in no particular order, stopping at the first error
+	ForEach(ctx context.Context, fn func(Media) error) error
+
+	// Revoke adds the subject (i.e. the name of a client) to the revocation list, so that its requests get rejected
+	Revoke(ctx context.Context, subject string) error
+
+	// Unrevoke removes the subject from the revocation list
+	Unrevoke(ctx context.Context, subject string) error
+
+	// IsRevoked reports whether the subject is in the revocation list
+	IsRevoked(ctx context.Context, subject string) (bool, error)
+
+	// AddUsage adds bytes to the storage used by the subject (i.e. the name of a client), or removes them if negative
+	AddUsage(ctx context.Context, subject string, bytes int64) error
+
+	// ReserveUsage atomically adds bytes to the storage used by the subject, unless that would exceed quota (if
+	// positive): it returns the storage used afterwards, and whether the bytes have been added
+	ReserveUsage(ctx context.Context, subject string, bytes, quota int64) (int64, bool, error)
+
+	// Usage returns the storage used by the subject, in bytes
+	Usage(ctx context.Context, subject string) (int64, error)
+
+	// StoreEnrollment stores an enrollment in the database, which expires after ttl
+	StoreEnrollment(ctx context.Context, enrollment Enrollment, ttl time.Duration) error
+
+	// ConsumeEnrollment atomically returns and deletes the enrollment with the given code, if it has not expired yet
+	ConsumeEnrollment(ctx context.Context, code string) (*Enrollment, error)
+
+	// StoreUploadSession stores an upload session in the database, (re)setting its expiration to ttl
+	StoreUploadSession(ctx context.Context, session UploadSession, ttl time.Duration) error
+
+	// GetUploadSession returns the upload session of the media with the given hash, if it has not expired yet
+	GetUploadSession(ctx context.Context, hash []byte) (*UploadSession, error)
+
+	// DeleteUploadSession deletes the upload session of the media with the given hash
+	DeleteUploadSession(ctx context.Context, hash []byte) error
 }
@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/fs"
+
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+)
+
+type Downloader interface {
+	// Download downloads the archived files with the given hashes to destDir, without overwriting existing files
+	Download(ctx context.Context, destDir string, hashes [][]byte) error
+}
+
+type downloader struct {
+	client arkv1connect.ArkApiClient
+	logger *zap.Logger
+}
+
+func NewDownloader(client arkv1connect.ArkApiClient, logger *zap.Logger) *downloader {
+	return &downloader{
+		client: client,
+		logger: logger,
+	}
+}
+
+func (d *downloader) Download(ctx context.Context, destDir string, hashes [][]byte) error {
+	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create destination directory %v: %w", destDir, err)
+	}
+
+	var errs []error
+	for _, hash := range hashes {
+		path, err := d.download(ctx, destDir, hash)
+		if err != nil {
+			d.logger.Error("Unable to download file", zap.String("hash", fmt.Sprintf("%x", hash)), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%x: %w", hash, err))
+			continue
+		}
+
+		d.logger.Info("Downloaded file", zap.String("hash", fmt.Sprintf("%x", hash)), zap.String("path", path))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d *downloader) download(ctx context.Context, destDir string, hash []byte) (string, error) {
+	stream, err := d.client.DownloadFile(ctx, connect.NewRequest(&arkv1.DownloadFileRequest{Hash: hash}))
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	if !stream.Receive() {
+		if stream.Err() != nil {
+			return "", stream.Err()
+		}
+		return "", errors.New("expected metadata")
+	}
+
+	metadata := stream.Msg().GetMetadata()
+	if metadata == nil {
+		return "", errors.New("expected metadata")
+	}
+
+	f, err := os.CreateTemp(destDir, ".ark-download-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temp file: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	h := fs.NewHash()
+	w := io.MultiWriter(f, h)
+
+	var size int64
+	for stream.Receive() {
+		n, err := w.Write(stream.Msg().GetChunk().GetData())
+		if err != nil {
+			return "", fmt.Errorf("cannot write data to temp file %q: %v", f.Name(), err)
+		}
+		size += int64(n)
+	}
+
+	if err := stream.Err(); err != nil {
+		return "", err
+	}
+
+	if size != metadata.GetSize() {
+		return "", fmt.Errorf("total size mismatch: expected %v, got %v", metadata.GetSize(), size)
+	}
+
+	if sum := h.Sum(nil); !bytes.Equal(sum, hash) {
+		return "", fmt.Errorf("hash mismatch: expected %x, got %x", hash, sum)
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("cannot flush temp file %q: %v", f.Name(), err)
+	}
+
+	path := filepath.Join(destDir, filepath.Base(metadata.GetName()))
+	// unlike os.Rename, os.Link fails if the target already exists
+	if err := os.Link(f.Name(), path); err != nil {
+		return "", fmt.Errorf("cannot move temp file %s to %s: %v", f.Name(), path, err)
+	}
+
+	createdAt := metadata.GetCreatedAt().AsTime()
+	if err := os.Chtimes(path, createdAt, createdAt); err != nil {
+		return "", fmt.Errorf("cannot set modification time of %s: %v", path, err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,225 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashCacheVersion is the version of the format of the hash cache file: files with a different version are discarded
+const hashCacheVersion = 1
+
+// CachedHash is the hash of a file, which remains valid as long as the size, modification time and inode of the file do
+// not change.
+type CachedHash struct {
+	Path    string    `json:"-"`
+	Hash    []byte    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Inode   uint64    `json:"inode"`
+}
+
+func (c CachedHash) matches(info os.FileInfo) bool {
+	return c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) && c.Inode == inode(info)
+}
+
+// HashCache keeps the hashes of files across runs, so that unchanged files do not need to be hashed again. It is kept in
+// memory and written back to its file by Save.
+type HashCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]CachedHash
+	dirty   bool
+}
+
+type hashCacheFile struct {
+	Version int                   `json:"version"`
+	Entries map[string]CachedHash `json:"entries"`
+}
+
+// OpenHashCache reads the hash cache stored in path, which does not need to exist yet.
+func OpenHashCache(path string) (*HashCache, error) {
+	c := &HashCache{
+		path:    path,
+		entries: make(map[string]CachedHash),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	var f hashCacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("unable to read hash cache %v: %w", path, err)
+	}
+
+	if f.Version == hashCacheVersion && f.Entries != nil {
+		c.entries = f.Entries
+	}
+
+	return c, nil
+}
+
+// Get returns the cached hash of the file at path, provided that the file has not changed since it was hashed.
+func (c *HashCache) Get(path string, info os.FileInfo) ([]byte, bool) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !entry.matches(info) {
+		return nil, false
+	}
+
+	return entry.Hash, true
+}
+
+// Put caches the hash of the file at path.
+func (c *HashCache) Put(path string, info os.FileInfo, hash []byte) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = CachedHash{
+		Hash:    hash,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Inode:   inode(info),
+	}
+	c.dirty = true
+}
+
+// Entries returns the cached hashes of the files under the given directory (or of all files, if empty), sorted by path.
+func (c *HashCache) Entries(dir string) []CachedHash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []CachedHash
+	for path, entry := range c.entries {
+		if under(path, dir) {
+			entry.Path = path
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	return entries
+}
+
+// Prune removes the cached hashes of the files that no longer exist or have changed since they were hashed, returning
+// how many have been removed.
+func (c *HashCache) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed int
+	for path, entry := range c.entries {
+		info, err := os.Stat(path)
+		if err == nil && entry.matches(info) {
+			continue
+		}
+
+		delete(c.entries, path)
+		removed++
+	}
+
+	c.dirty = c.dirty || removed > 0
+
+	return removed
+}
+
+// Invalidate removes the cached hashes of the files under the given directory (or of all files, if empty), returning
+// how many have been removed: these files are hashed again the next time they are walked.
+func (c *HashCache) Invalidate(dir string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed int
+	for path := range c.entries {
+		if under(path, dir) {
+			delete(c.entries, path)
+			removed++
+		}
+	}
+
+	c.dirty = c.dirty || removed > 0
+
+	return removed
+}
+
+// Save writes the hash cache back to its file, if it has changed.
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(hashCacheFile{Version: hashCacheVersion, Entries: c.entries})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that an interrupted run never leaves a truncated cache behind
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// under reports whether path is dir or lies under it: any path lies under an empty dir.
+func under(path, dir string) bool {
+	if dir == "" {
+		return true
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	return path == abs || strings.HasPrefix(path, abs+string(filepath.Separator))
+}
@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func walkHashes(t *testing.T, root string, cache *HashCache) map[string][]byte {
+	t.Helper()
+
+	hashes := make(map[string][]byte)
+	for m := range Walk(context.Background(), root, []string{"jpg"}, WithHashCache(cache)) {
+		if m.Err != nil {
+			t.Fatal(m.Err)
+		}
+		hashes[filepath.Base(m.Path)] = m.Hash
+	}
+
+	return hashes
+}
+
+func TestWalk_UsesHashCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.jpg"), "a")
+	writeFile(t, filepath.Join(dir, "b.jpg"), "b")
+
+	cache, err := OpenHashCache(filepath.Join(dir, "cache", "hashes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := walkHashes(t, dir, cache)
+	if len(cache.Entries("")) != 2 {
+		t.Fatalf("expected 2 cached hashes, got %v", len(cache.Entries("")))
+	}
+
+	// tamper with the cached hash of a.jpg, to tell whether it is used
+	info, err := os.Stat(filepath.Join(dir, "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(filepath.Join(dir, "a.jpg"), info, []byte("cached"))
+
+	// b.jpg changes, so its cached hash is no longer valid
+	writeFile(t, filepath.Join(dir, "b.jpg"), "changed")
+
+	second := walkHashes(t, dir, cache)
+	if !bytes.Equal(second["a.jpg"], []byte("cached")) {
+		t.Errorf("expected the cached hash of a.jpg to be used")
+	}
+
+	if bytes.Equal(second["b.jpg"], first["b.jpg"]) {
+		t.Errorf("expected b.jpg to be hashed again")
+	}
+}
+
+func TestHashCache_SaveAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jpg")
+	writeFile(t, path, "a")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cachePath := filepath.Join(dir, "cache", "hashes.json")
+	cache, err := OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(path, info, []byte("hash"))
+
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	reopened, err := OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, ok := reopened.Get(path, info); !ok || !bytes.Equal(hash, []byte("hash")) {
+		t.Errorf("expected the hash to survive a restart, got %v", hash)
+	}
+}
+
+func TestHashCache_PruneAndInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{
+		filepath.Join(dir, "kept.jpg"),
+		filepath.Join(dir, "deleted.jpg"),
+		filepath.Join(dir, "changed.jpg"),
+		filepath.Join(dir, "sub", "a.jpg"),
+		filepath.Join(dir, "sub", "b.jpg"),
+	}
+
+	cache, err := OpenHashCache(filepath.Join(dir, "hashes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		writeFile(t, path, "content")
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Put(path, info, []byte("hash"))
+	}
+
+	if err := os.Remove(paths[1]); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, paths[2], "changed content")
+
+	if removed := cache.Prune(); removed != 2 {
+		t.Errorf("expected 2 pruned hashes, got %v", removed)
+	}
+
+	if removed := cache.Invalidate(filepath.Join(dir, "sub")); removed != 2 {
+		t.Errorf("expected 2 invalidated hashes, got %v", removed)
+	}
+
+	entries := cache.Entries("")
+	if len(entries) != 1 || entries[0].Path != paths[0] {
+		t.Errorf("expected only %v to be left, got %v", paths[0], entries)
+	}
+}
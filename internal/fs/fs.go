@@ -1,16 +1,26 @@
 package fs
 
 import (
+	"context"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/fedragon/ark/internal/db"
 
 	"lukechampine.com/blake3"
 )
 
+// NewHash returns the hash function used to identify media files.
+func NewHash() hash.Hash {
+	return blake3.New(256, nil)
+}
+
 func Hash(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -18,7 +28,7 @@ func Hash(path string) ([]byte, error) {
 	}
 	defer f.Close()
 
-	h := blake3.New(256, nil)
+	h := NewHash()
 	if _, err := io.Copy(h, f); err != nil {
 		return nil, err
 	}
@@ -26,14 +36,134 @@ func Hash(path string) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+const (
+	// StageWalk is the stage of the failures to list a directory (or to stat a file)
+	StageWalk = "walk"
+	// StageHash is the stage of the failures to read a file
+	StageHash = "hash"
+)
+
+// FileError is the error of a file (or directory) that could not be walked or hashed.
+type FileError struct {
+	Path  string
+	Stage string
+	Err   error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("unable to %s %v: %v", e.Stage, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// WalkOption configures Walk.
+type WalkOption func(*walkConfig)
+
+type walkConfig struct {
+	cache           *HashCache
+	hashers         int
+	queueSize       int
+	continueOnError bool
+	exclude         map[string]struct{}
+}
+
+// WithHashCache makes Walk look up the hashes of files in cache before computing them, caching the ones it computes.
+func WithHashCache(cache *HashCache) WalkOption {
+	return func(c *walkConfig) {
+		c.cache = cache
+	}
+}
+
+// WithHashers sets how many files Walk hashes at the same time (as many as the CPUs, by default).
+func WithHashers(n int) WalkOption {
+	return func(c *walkConfig) {
+		if n > 0 {
+			c.hashers = n
+		}
+	}
+}
+
+// WithQueueSize sets how many files can be waiting to be hashed, as well as how many hashed files can be waiting to be
+// received, before Walk stops walking (twice as many as the hashers, by default).
+func WithQueueSize(n int) WalkOption {
+	return func(c *walkConfig) {
+		if n > 0 {
+			c.queueSize = n
+		}
+	}
+}
+
+// WithContinueOnError makes Walk skip the files (and directories) it cannot walk or hash, sending their errors to the
+// returned channel and carrying on with the other ones.
+func WithContinueOnError() WalkOption {
+	return func(c *walkConfig) {
+		c.continueOnError = true
+	}
+}
+
+// WithExclude makes Walk skip the given directories, together with all their contents.
+func WithExclude(dirs ...string) WalkOption {
+	return func(c *walkConfig) {
+		if c.exclude == nil {
+			c.exclude = make(map[string]struct{})
+		}
+		for _, dir := range dirs {
+			c.exclude[filepath.Clean(dir)] = struct{}{}
+		}
+	}
+}
+
 // Walk traverses the directory tree rooted at root, sending all media files (with extensions in fileTypes) to the
-// returned channel. It spawns a goroutine to walk the tree and immediately returns a read-only channel to receive
-// the values. In case of errors, the channel will receive Media with the Err field set.
-func Walk(root string, fileTypes []string) <-chan db.Media {
-	media := make(chan db.Media)
+// returned channel. It spawns a goroutine to walk the tree, and a pool of goroutines to hash the files it finds, and
+// immediately returns a read-only channel to receive the values: files are therefore received in no particular order.
+// In case of errors, the channel will receive Media with the Err field set to a *FileError, after which walking stops
+// unless WithContinueOnError is used. Walking also stops as soon as ctx is done, in which case the channel is closed
+// without any error: receivers that stop early must therefore cancel ctx, so that no goroutine is left behind.
+func Walk(ctx context.Context, root string, fileTypes []string, opts ...WalkOption) <-chan db.Media {
+	cfg := walkConfig{hashers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.queueSize == 0 {
+		cfg.queueSize = 2 * cfg.hashers
+	}
+
+	paths := make(chan string, cfg.queueSize)
+	media := make(chan db.Media, cfg.queueSize)
+
+	// stop is cancelled after the first error is sent (unless continuing on errors): only the files being hashed at
+	// that time may still follow it
+	stop, cancel := context.WithCancel(ctx)
+
+	send := func(m db.Media) bool {
+		select {
+		case media <- m:
+			return true
+		case <-stop.Done():
+			return false
+		}
+	}
+
+	var once sync.Once
+	fail := func(m db.Media) {
+		if cfg.continueOnError {
+			send(m)
+			return
+		}
+
+		once.Do(func() {
+			select {
+			case media <- m:
+			case <-ctx.Done():
+			}
+			cancel()
+		})
+	}
 
 	go func() {
-		defer close(media)
+		defer close(paths)
 
 		typesMap := make(map[string]struct{})
 		for _, t := range fileTypes {
@@ -42,26 +172,27 @@ func Walk(root string, fileTypes []string) <-chan db.Media {
 
 		err := filepath.WalkDir(root, func(path string, f os.DirEntry, err error) error {
 			if err != nil {
-				return err
+				ferr := &FileError{Path: path, Stage: StageWalk, Err: err}
+				if !cfg.continueOnError {
+					return ferr
+				}
+
+				// the contents of an unreadable directory are skipped, the rest of the tree is not
+				fail(db.Media{Path: path, Err: ferr})
+				return nil
 			}
 
-			if !f.IsDir() {
+			if f.IsDir() {
+				if _, excluded := cfg.exclude[filepath.Clean(path)]; excluded {
+					return filepath.SkipDir
+				}
+			} else {
 				ext := strings.ToLower(filepath.Ext(f.Name()))
 				if _, exists := typesMap[ext]; exists {
-					bytes, err := Hash(path)
-					if err != nil {
-						return err
-					}
-
-					stat, err := os.Stat(path)
-					if err != nil {
-						return err
-					}
-
-					media <- db.Media{
-						Path:      path,
-						Hash:      bytes,
-						CreatedAt: stat.ModTime(),
+					select {
+					case paths <- path:
+					case <-stop.Done():
+						return filepath.SkipAll
 					}
 				}
 			}
@@ -70,9 +201,68 @@ func Walk(root string, fileTypes []string) <-chan db.Media {
 		})
 
 		if err != nil {
-			media <- db.Media{Err: err}
+			fail(db.Media{Err: err})
 		}
 	}()
 
+	var hashers sync.WaitGroup
+	for range cfg.hashers {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+
+			for path := range paths {
+				if stop.Err() != nil {
+					// keep draining paths, so that the walk does not block
+					continue
+				}
+
+				stat, err := os.Stat(path)
+				if err != nil {
+					fail(db.Media{Path: path, Err: &FileError{Path: path, Stage: StageWalk, Err: err}})
+					continue
+				}
+
+				bytes, err := hashFile(path, stat, cfg.cache)
+				if err != nil {
+					fail(db.Media{Path: path, Err: &FileError{Path: path, Stage: StageHash, Err: err}})
+					continue
+				}
+
+				send(db.Media{
+					Path:      path,
+					Hash:      bytes,
+					CreatedAt: stat.ModTime(),
+				})
+			}
+		}()
+	}
+
+	go func() {
+		hashers.Wait()
+		cancel()
+		close(media)
+	}()
+
 	return media
 }
+
+// hashFile returns the hash of the file at path, looking it up in cache first (if not nil).
+func hashFile(path string, info os.FileInfo, cache *HashCache) ([]byte, error) {
+	if cache == nil {
+		return Hash(path)
+	}
+
+	if cached, ok := cache.Get(path, info); ok {
+		return cached, nil
+	}
+
+	h, err := Hash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Put(path, info, h)
+
+	return h, nil
+}
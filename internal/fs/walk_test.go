@@ -1,6 +1,11 @@
 package fs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	_ "github.com/fedragon/ark/testing"
@@ -25,17 +30,104 @@ func TestWalk(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		var count int
-		for i := range Walk(c.root, []string{"jpg"}) {
-			if i.Err != nil {
-				t.Errorf("error: %v", i.Err.Error())
+		for _, hashers := range []int{1, 4} {
+			var found int
+			for i := range Walk(context.Background(), c.root, []string{"jpg"}, WithHashers(hashers), WithQueueSize(1)) {
+				if i.Err != nil {
+					t.Errorf("error: %v", i.Err.Error())
+				}
+
+				found++
+			}
+
+			if found != c.expected {
+				t.Errorf("%v (%v hashers)\n\tExpected %v but got %v instead", c.name, hashers, c.expected, found)
 			}
+		}
+	}
+}
+
+func TestWalk_SkipsExcludedDirectories(t *testing.T) {
+	var found []string
+	for i := range Walk(context.Background(), "./test/testdata", []string{"jpg"}, WithExclude("./test/testdata/a")) {
+		if i.Err != nil {
+			t.Errorf("error: %v", i.Err.Error())
+		}
+
+		found = append(found, i.Path)
+	}
+
+	if len(found) != 3 {
+		t.Errorf("expected 3 media, got %v", found)
+	}
+	for _, path := range found {
+		if filepath.Dir(path) != filepath.Clean("./test/testdata") {
+			t.Errorf("unexpected media in excluded directory: %v", path)
+		}
+	}
+}
+
+func TestWalk_StopsAtFirstError(t *testing.T) {
+	var errs int
+	for i := range Walk(context.Background(), "./test/testdata/missing", []string{"jpg"}, WithHashers(4)) {
+		if i.Err == nil {
+			t.Errorf("unexpected media: %v", i.Path)
+		}
+		errs++
+	}
 
-			count++
+	if errs != 1 {
+		t.Errorf("expected exactly one error, got %v", errs)
+	}
+}
+
+func TestWalk_ContinuesOnError(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.jpg"), "a")
+	writeFile(t, filepath.Join(dir, "b.jpg"), "b")
+	// a dangling symlink cannot be hashed
+	if err := os.Symlink(filepath.Join(dir, "missing.jpg"), filepath.Join(dir, "broken.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	var found, failed int
+	for i := range Walk(context.Background(), dir, []string{"jpg"}, WithHashers(4), WithContinueOnError()) {
+		if i.Err == nil {
+			found++
+			continue
 		}
 
-		if count != c.expected {
-			t.Errorf("%v\n\tExpected %v but got %v instead", c.name, c.expected, count)
+		var ferr *FileError
+		if !errors.As(i.Err, &ferr) || ferr.Path != filepath.Join(dir, "broken.jpg") {
+			t.Errorf("unexpected error: %v", i.Err)
 		}
+		failed++
+	}
+
+	if found != 2 || failed != 1 {
+		t.Errorf("expected 2 media and 1 error, got %v media and %v errors", found, failed)
+	}
+}
+
+func TestWalk_StopsWhenContextIsDone(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 50 {
+		writeFile(t, filepath.Join(dir, fmt.Sprintf("%02d.jpg", i)), fmt.Sprint(i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	media := Walk(ctx, dir, []string{"jpg"}, WithHashers(2), WithQueueSize(1))
+
+	// stop after the first file: only the files already on their way may follow, before the channel gets closed
+	<-media
+	cancel()
+
+	var received int
+	for range media {
+		received++
+	}
+
+	if received > 5 {
+		t.Errorf("expected walking to stop, got %v more files", received)
 	}
 }
@@ -74,6 +74,64 @@ func ParseCreatedAt(path string) (time.Time, error) {
 	return time.Time{}, notFound(ext)
 }
 
+// ParseCameraModel returns the model of the camera that produced the file, as recorded in its EXIF data.
+func ParseCameraModel(path string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if parser, ok := parsers[ext]; ok {
+		ctx, err := parser.ParseFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		ifd, _, err := ctx.Exif()
+		if err != nil {
+			if err.Error() == "no exif data" {
+				return "", notFound(ext)
+			}
+			return "", err
+		}
+
+		tags, err := ifd.FindTagWithId(0x0110) // model
+		if err != nil {
+			return "", notFound(ext)
+		}
+
+		for _, tag := range tags {
+			value, err := tag.Value()
+			if err != nil {
+				return "", err
+			}
+
+			return strings.TrimRight(value.(string), "\x00 "), nil
+		}
+	}
+
+	if _, ok := tiffs[ext]; ok {
+		reader, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+
+		parser, err := tiff.NewParser(reader)
+		if err != nil {
+			return "", err
+		}
+
+		entries, err := parser.Parse(tiff.Model)
+		if err != nil {
+			return "", err
+		}
+
+		if en, ok := entries[tiff.Model]; ok && en.DataType == tiff.DataType_String {
+			return strings.TrimRight(*en.Value.String, "\x00 "), nil
+		}
+	}
+
+	return "", notFound(ext)
+}
+
 func parse(parser img.MediaParser, path string) (time.Time, error, bool) {
 	ctx, err := parser.ParseFile(path)
 	if err != nil {
@@ -3,10 +3,13 @@ package importer
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"os"
 	"runtime"
+	"sort"
+	"sync"
 
 	arkv1 "github.com/fedragon/ark/gen/ark/v1"
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
@@ -19,55 +22,362 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	// Files at least this big are uploaded through a resumable upload session, so that an interrupted upload does not
+	// have to start over from byte zero.
+	resumableUploadMinSize = 32 * 1024 * 1024
+
+	// Number of hashes checked with a single FindDuplicates request
+	duplicatesBatchSize = 100
+)
+
+const (
+	// StageCheck is the stage of the failures to check whether files are already known to the server
+	StageCheck = "check"
+	// StageUpload is the stage of the failures to upload files
+	StageUpload = "upload"
+	// StageLayout is the stage of the failures to read the attributes of files that the archive layout depends on
+	StageLayout = "layout"
+)
+
+// Failure is a file that could not be imported, because of an error at the given stage (see fs.StageWalk, fs.StageHash,
+// StageCheck and StageUpload).
+type Failure struct {
+	Path  string
+	Stage string
+	Err   error
+}
+
+func (f Failure) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path  string `json:"path"`
+		Stage string `json:"stage"`
+		Error string `json:"error"`
+	}{f.Path, f.Stage, f.Err.Error()})
+}
+
+// Summary tells what an import did.
+type Summary struct {
+	Imported   int
+	Duplicates int
+	// Retries is how many times uploads failing with transient errors have been retried, overall
+	Retries int
+	// Failures are only recorded when continuing on errors, sorted by path
+	Failures []Failure
+}
+
+// summary accumulates the Summary of an import, on behalf of concurrent goroutines.
+type summary struct {
+	mu sync.Mutex
+	Summary
+}
+
+func (s *summary) imported() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Imported++
+}
+
+func (s *summary) duplicate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Duplicates++
+}
+
+func (s *summary) retried() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Retries++
+}
+
+func (s *summary) fail(err *fs.FileError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Failures = append(s.Failures, Failure{Path: err.Path, Stage: err.Stage, Err: err.Err})
+}
+
+func (s *summary) result() *Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := s.Summary
+	sort.Slice(result.Failures, func(i, j int) bool { return result.Failures[i].Path < result.Failures[j].Path })
+
+	return &result
+}
+
 type Importer interface {
-	// Import imports all files in sourceDir, skipping duplicates
-	Import(ctx context.Context, sourceDir string) error
+	// Import imports all files in sourceDir, skipping duplicates: it stops at the first error, unless continuing on
+	// errors, in which case the files that could not be imported are listed in the summary instead
+	Import(ctx context.Context, sourceDir string) (*Summary, error)
+
+	// Plan tells what importing all files in sourceDir would do, without uploading anything
+	Plan(ctx context.Context, sourceDir string) (*Plan, error)
+}
+
+// Option configures an importer.
+type Option func(*importer)
+
+// WithWalkOptions sets the options files are walked (and hashed) with, e.g. to use a hash cache.
+func WithWalkOptions(opts ...fs.WalkOption) Option {
+	return func(imp *importer) {
+		imp.walkOptions = append(imp.walkOptions, opts...)
+	}
+}
+
+// WithContinueOnError makes the importer carry on with the other files when one cannot be walked, hashed, checked or
+// uploaded, recording a Failure instead.
+func WithContinueOnError() Option {
+	return func(imp *importer) {
+		imp.continueOnError = true
+		imp.walkOptions = append(imp.walkOptions, fs.WithContinueOnError())
+	}
+}
+
+// WithSenders sets how many files are uploaded at the same time (as many as the CPUs, by default).
+func WithSenders(n int) Option {
+	return func(imp *importer) {
+		if n > 0 {
+			imp.senders = n
+		}
+	}
+}
+
+// WithQueueSize sets how many files, not known to the server, can be waiting to be uploaded (twice as many as the
+// senders, by default).
+func WithQueueSize(n int) Option {
+	return func(imp *importer) {
+		if n > 0 {
+			imp.queueSize = n
+		}
+	}
 }
 
 type importer struct {
-	client    arkv1connect.ArkApiClient
-	fileTypes []string
-	logger    *zap.Logger
+	client      arkv1connect.ArkApiClient
+	fileTypes   []string
+	walkOptions []fs.WalkOption
+	senders     int
+	queueSize   int
+	retries     RetryPolicy
+	logger      *zap.Logger
+
+	continueOnError bool
 }
 
-func NewImporter(client arkv1connect.ArkApiClient, fileTypes []string, logger *zap.Logger) *importer {
-	return &importer{
+// NewImporter returns an importer of the files with extensions in fileTypes: files are walked, hashed and uploaded by
+// separate pools of goroutines, connected by bounded queues, so that hashing and uploading overlap.
+func NewImporter(client arkv1connect.ArkApiClient, fileTypes []string, logger *zap.Logger, opts ...Option) *importer {
+	imp := &importer{
 		client:    client,
 		fileTypes: fileTypes,
+		senders:   runtime.NumCPU(),
+		retries:   DefaultRetryPolicy,
 		logger:    logger,
 	}
+	for _, opt := range opts {
+		opt(imp)
+	}
+	if imp.queueSize == 0 {
+		imp.queueSize = 2 * imp.senders
+	}
+
+	return imp
 }
 
-func (imp *importer) Import(ctx context.Context, sourceDir string) error {
-	group := errgroup.Group{}
+func (imp *importer) Import(ctx context.Context, sourceDir string) (*Summary, error) {
+	// stop walking (and uploading) if returning early
+	importCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	group := new(errgroup.Group)
+	if !imp.continueOnError {
+		// the first error stops the whole import
+		group, importCtx = errgroup.WithContext(importCtx)
+	}
+
+	var s summary
 	sendOne := func(ctx context.Context, in <-chan db.Media) error {
 		for m := range in {
 			if m.Err != nil {
-				return m.Err
+				var ferr *fs.FileError
+				if !imp.continueOnError || !errors.As(m.Err, &ferr) {
+					return m.Err
+				}
+
+				imp.logger.Warn("Unable to import file", zap.String("path", ferr.Path), zap.String("stage", ferr.Stage), zap.Error(ferr.Err))
+				s.fail(ferr)
+				continue
 			}
 
-			if _, err := imp.send(ctx, m); err != nil {
+			if _, err := imp.sendWithRetries(ctx, m, &s); err != nil {
 				var cerr *connect.Error
-				if !errors.As(err, &cerr) || cerr.Code() != connect.CodeAlreadyExists {
+				if errors.As(err, &cerr) && cerr.Code() == connect.CodeAlreadyExists {
+					imp.logger.Info("Skipped duplicate file %s", zap.String("path", m.Path))
+					s.duplicate()
+					continue
+				}
+
+				// a cancelled import is not a failure of the files still being uploaded
+				if !imp.continueOnError || ctx.Err() != nil {
 					return err
 				}
 
-				imp.logger.Info("Skipped duplicate file %s", zap.String("path", m.Path))
+				imp.logger.Warn("Unable to import file", zap.String("path", m.Path), zap.String("stage", StageUpload), zap.Error(err))
+				s.fail(&fs.FileError{Path: m.Path, Stage: StageUpload, Err: err})
 				continue
 			}
 
 			imp.logger.Info("Imported file", zap.String("path", m.Path))
+			s.imported()
 		}
 
 		return nil
 	}
 
-	allMedia := fs.Walk(sourceDir, imp.fileTypes)
-	for i := 0; i < runtime.NumCPU(); i++ {
-		group.Go(func() error { return sendOne(ctx, allMedia) })
+	allMedia := imp.skipDuplicates(importCtx, fs.Walk(importCtx, sourceDir, imp.fileTypes, imp.walkOptions...), &s)
+	for i := 0; i < imp.senders; i++ {
+		group.Go(func() error { return sendOne(importCtx, allMedia) })
+	}
+
+	err := group.Wait()
+	if err == nil {
+		// the walk stops short, without errors, if ctx is done
+		err = ctx.Err()
+	}
+
+	return s.result(), err
+}
+
+// skipDuplicates asks the server, in batches, which of the media received from in are already known, only forwarding
+// the other ones to the returned channel. In case of errors, the channel will receive Media with the Err field set:
+// unless continuing on errors, nothing is forwarded after that.
+func (imp *importer) skipDuplicates(ctx context.Context, in <-chan db.Media, s *summary) <-chan db.Media {
+	out := make(chan db.Media, imp.queueSize)
+
+	go func() {
+		defer close(out)
+
+		forward := func(m db.Media) bool {
+			select {
+			case out <- m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		flush := func(batch []db.Media) bool {
+			if len(batch) == 0 {
+				return true
+			}
+
+			duplicates, err := imp.findDuplicates(ctx, batch)
+			if err != nil {
+				if !imp.continueOnError || ctx.Err() != nil {
+					forward(db.Media{Err: err})
+					return false
+				}
+
+				// the files of the batch cannot be told apart from duplicates: skip them all
+				for _, m := range batch {
+					if !forward(db.Media{Path: m.Path, Err: &fs.FileError{Path: m.Path, Stage: StageCheck, Err: err}}) {
+						return false
+					}
+				}
+
+				return true
+			}
+
+			for _, m := range batch {
+				if path, ok := duplicates[string(m.Hash)]; ok {
+					imp.logger.Info("Skipped duplicate file", zap.String("path", m.Path), zap.String("archive_path", path))
+					s.duplicate()
+					continue
+				}
+
+				if !forward(m) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		batch := make([]db.Media, 0, duplicatesBatchSize)
+		for m := range in {
+			if m.Err != nil {
+				if !forward(m) || !imp.continueOnError {
+					return
+				}
+				continue
+			}
+
+			batch = append(batch, m)
+			if len(batch) == duplicatesBatchSize {
+				if !flush(batch) {
+					return
+				}
+				batch = batch[:0]
+			}
+		}
+
+		flush(batch)
+	}()
+
+	return out
+}
+
+// findDuplicates returns the archive paths of the media that are already known to the server, by hash.
+func (imp *importer) findDuplicates(ctx context.Context, batch []db.Media) (map[string]string, error) {
+	hashes := make([][]byte, len(batch))
+	for i, m := range batch {
+		hashes[i] = m.Hash
+	}
+
+	res, err := imp.client.FindDuplicates(ctx, connect.NewRequest(&arkv1.FindDuplicatesRequest{Hashes: hashes}))
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make(map[string]string, len(res.Msg.GetDuplicates()))
+	for _, d := range res.Msg.GetDuplicates() {
+		duplicates[string(d.GetHash())] = d.GetPath()
 	}
 
-	return group.Wait()
+	return duplicates, nil
+}
+
+// sendWithRetries uploads m, retrying (as per the retry policy) as long as the upload fails with transient errors.
+// Large files resume from where the failed attempt left off, since each attempt opens a new upload session.
+func (imp *importer) sendWithRetries(ctx context.Context, m db.Media, s *summary) (*connect.Response[arkv1.UploadFileResponse], error) {
+	for retry := 0; ; retry++ {
+		res, err := imp.send(ctx, m)
+		if err == nil || retry >= imp.retries.MaxRetries || ctx.Err() != nil {
+			return res, err
+		}
+
+		ok, delay := retryable(err)
+		if !ok {
+			return nil, err
+		}
+
+		// the server knows best how long to wait, when it says so
+		if delay <= 0 {
+			delay = imp.retries.backoff(retry)
+		}
+
+		imp.logger.Warn("Retrying upload", zap.String("path", m.Path), zap.Int("retry", retry+1), zap.Duration("delay", delay), zap.Error(err))
+		s.retried()
+
+		if err := wait(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
 }
 
 func (imp *importer) send(ctx context.Context, m db.Media) (*connect.Response[arkv1.UploadFileResponse], error) {
@@ -82,15 +392,35 @@ func (imp *importer) send(ctx context.Context, m db.Media) (*connect.Response[ar
 		return nil, err
 	}
 
+	metadata := &arkv1.Metadata{
+		Hash:      m.Hash,
+		Name:      m.Path,
+		Size:      stat.Size(),
+		CreatedAt: timestamppb.New(stat.ModTime()),
+	}
+
+	if stat.Size() >= resumableUploadMinSize {
+		res, err := imp.client.OpenUploadSession(ctx, connect.NewRequest(&arkv1.OpenUploadSessionRequest{Metadata: metadata}))
+		if err != nil {
+			return nil, err
+		}
+
+		metadata.SessionId = res.Msg.GetSessionId()
+		metadata.Offset = res.Msg.GetOffset()
+
+		if metadata.Offset > 0 {
+			if _, err := file.Seek(metadata.Offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+
+			imp.logger.Info("Resuming upload", zap.String("path", m.Path), zap.Int64("offset", metadata.Offset))
+		}
+	}
+
 	stream := imp.client.UploadFile(ctx)
 	err = stream.Send(&arkv1.UploadFileRequest{
 		File: &arkv1.UploadFileRequest_Metadata{
-			Metadata: &arkv1.Metadata{
-				Hash:      m.Hash,
-				Name:      m.Path,
-				Size:      stat.Size(),
-				CreatedAt: timestamppb.New(stat.ModTime()),
-			},
+			Metadata: metadata,
 		},
 	})
 	if err != nil {
@@ -0,0 +1,233 @@
+package importer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/layout"
+
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+)
+
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+const (
+	// ActionImport means that the file would be uploaded
+	ActionImport = "import"
+	// ActionDuplicate means that the file would be skipped, since the archive already holds (or would hold) its content
+	ActionDuplicate = "duplicate"
+)
+
+// PlannedFile tells what importing a file would do.
+type PlannedFile struct {
+	Path   string `json:"path"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	// ArchivePath is where the file would land in the archive, relative to its root: for duplicates, it is where their
+	// content already is (as reported by the server) or would be (if the same content is found more than once)
+	ArchivePath string `json:"archive_path"`
+}
+
+// Plan tells what importing a directory would do.
+type Plan struct {
+	Files           []PlannedFile `json:"files"`
+	ToImport        int           `json:"to_import"`
+	Duplicates      int           `json:"duplicates"`
+	BytesToTransfer int64         `json:"bytes_to_transfer"`
+	// Failures are the files that could not be planned, which are only recorded when continuing on errors, sorted by
+	// path
+	Failures []Failure `json:"failures,omitempty"`
+}
+
+func (imp *importer) Plan(ctx context.Context, sourceDir string) (*Plan, error) {
+	l, err := imp.layout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop walking if returning early
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	plan := &Plan{}
+	// fail records the error of a file, unless it must stop the whole plan
+	fail := func(err error) error {
+		var ferr *fs.FileError
+		if !imp.continueOnError || !errors.As(err, &ferr) {
+			return err
+		}
+
+		plan.Failures = append(plan.Failures, Failure{Path: ferr.Path, Stage: ferr.Stage, Err: ferr.Err})
+		return nil
+	}
+
+	var all []db.Media
+	for m := range fs.Walk(walkCtx, sourceDir, imp.fileTypes, imp.walkOptions...) {
+		if m.Err != nil {
+			if err := fail(m.Err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		all = append(all, m)
+	}
+
+	// the walk stops short, without errors, if ctx is done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// files are walked in no particular order: sort them, so that the plan is stable across runs
+	sort.Slice(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+
+	plan.Files = make([]PlannedFile, 0, len(all))
+	// archive paths of the files planned so far, by hash
+	planned := make(map[string]string)
+
+	for start := 0; start < len(all); start += duplicatesBatchSize {
+		batch := all[start:min(start+duplicatesBatchSize, len(all))]
+
+		duplicates, err := imp.findDuplicates(ctx, batch)
+		if err != nil {
+			if !imp.continueOnError || ctx.Err() != nil {
+				return nil, err
+			}
+
+			// the files of the batch cannot be told apart from duplicates: skip them all
+			for _, m := range batch {
+				_ = fail(&fs.FileError{Path: m.Path, Stage: StageCheck, Err: err})
+			}
+			continue
+		}
+
+		for _, m := range batch {
+			stat, err := os.Stat(m.Path)
+			if err != nil {
+				if err := fail(&fs.FileError{Path: m.Path, Stage: fs.StageWalk, Err: err}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			file := PlannedFile{
+				Path: m.Path,
+				Hash: hex.EncodeToString(m.Hash),
+				Size: stat.Size(),
+			}
+
+			if path, ok := duplicates[string(m.Hash)]; ok {
+				file.Action, file.ArchivePath = ActionDuplicate, path
+			} else if path, ok := planned[string(m.Hash)]; ok {
+				file.Action, file.ArchivePath = ActionDuplicate, path
+			} else {
+				attrs, err := l.ReadAttributes(m.Path, m.Path, m.Hash, m.CreatedAt)
+				if err != nil {
+					if err := fail(&fs.FileError{Path: m.Path, Stage: StageLayout, Err: err}); err != nil {
+						return nil, err
+					}
+					continue
+				}
+
+				dir, filename := l.Resolve(attrs)
+				file.Action, file.ArchivePath = ActionImport, filepath.Join(dir, filename)
+				planned[string(m.Hash)] = file.ArchivePath
+			}
+
+			switch file.Action {
+			case ActionImport:
+				plan.ToImport++
+				plan.BytesToTransfer += file.Size
+			case ActionDuplicate:
+				plan.Duplicates++
+			}
+
+			plan.Files = append(plan.Files, file)
+		}
+	}
+
+	sort.Slice(plan.Failures, func(i, j int) bool { return plan.Failures[i].Path < plan.Failures[j].Path })
+
+	return plan, nil
+}
+
+// layout returns the layout of the archive, as configured on the server.
+func (imp *importer) layout(ctx context.Context) (*layout.Layout, error) {
+	res, err := imp.client.GetLayout(ctx, connect.NewRequest(&arkv1.GetLayoutRequest{}))
+	if err != nil {
+		if connect.CodeOf(err) == connect.CodeUnimplemented {
+			imp.logger.Warn("Server does not report its layout, assuming the default one", zap.String("layout", layout.DefaultTemplate))
+			return layout.Default, nil
+		}
+		return nil, err
+	}
+
+	return layout.Parse(res.Msg.GetTemplate())
+}
+
+// WritePlan writes the plan to w, in the given format.
+func WritePlan(w io.Writer, plan *Plan, format string) error {
+	switch format {
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(tw, "ACTION\tPATH\tARCHIVE PATH\tSIZE"); err != nil {
+			return err
+		}
+
+		for _, f := range plan.Files {
+			if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", f.Action, f.Path, f.ArchivePath, f.Size); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "\n%d files to import (%d bytes to transfer), %d duplicates\n", plan.ToImport, plan.BytesToTransfer, plan.Duplicates); err != nil {
+			return err
+		}
+
+		if len(plan.Failures) == 0 {
+			return nil
+		}
+
+		if _, err := fmt.Fprintf(w, "\n%d files could not be planned:\n", len(plan.Failures)); err != nil {
+			return err
+		}
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(tw, "STAGE\tPATH\tERROR"); err != nil {
+			return err
+		}
+
+		for _, f := range plan.Failures {
+			if _, err := fmt.Fprintf(tw, "%s\t%s\t%v\n", f.Stage, f.Path, f.Err); err != nil {
+				return err
+			}
+		}
+
+		return tw.Flush()
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	default:
+		return fmt.Errorf("unknown format: %v", format)
+	}
+}
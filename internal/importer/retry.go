@@ -0,0 +1,113 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"syscall"
+	"time"
+
+	"connectrpc.com/connect"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// RetryPolicy tells how uploads failing with transient errors are retried, waiting for an exponentially growing
+// (jittered) backoff in between.
+type RetryPolicy struct {
+	// MaxRetries is how many times an upload is retried before giving up: zero disables retries
+	MaxRetries int
+	// InitialBackoff is how long to wait before the first retry, doubling at each of the following ones
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time to wait before each retry
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the policy uploads are retried with, unless configured otherwise.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// WithRetryPolicy sets how uploads failing with transient errors are retried (see DefaultRetryPolicy).
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(imp *importer) {
+		if p.MaxRetries < 0 {
+			p.MaxRetries = 0
+		}
+		if p.InitialBackoff <= 0 {
+			p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+		}
+		if p.MaxBackoff < p.InitialBackoff {
+			p.MaxBackoff = p.InitialBackoff
+		}
+
+		imp.retries = p
+	}
+}
+
+// backoff returns how long to wait before the given retry (starting from zero): half of it is random, so that the
+// senders of a client (and different clients) do not all retry at the same time.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MaxBackoff
+	if retry < 32 {
+		d = min(p.InitialBackoff<<retry, p.MaxBackoff)
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryable reports whether err is transient, i.e. whether the same upload may succeed if retried, together with how
+// long the server asked to wait before retrying (if it did).
+func retryable(err error) (bool, time.Duration) {
+	var cerr *connect.Error
+	if !errors.As(err, &cerr) {
+		// e.g. the file cannot be read: retrying would not help
+		return false, 0
+	}
+
+	switch cerr.Code() {
+	case connect.CodeUnavailable, connect.CodeAborted, connect.CodeDeadlineExceeded:
+		return true, retryDelay(cerr)
+	case connect.CodeResourceExhausted:
+		// limits worth waiting for (e.g. too many concurrent uploads) come with a delay, others (e.g. the storage
+		// quota) do not
+		delay := retryDelay(cerr)
+		return delay > 0, delay
+	case connect.CodeUnknown, connect.CodeInternal:
+		// connections reset (e.g. by a server restart) do not always surface as CodeUnavailable
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF), 0
+	default:
+		return false, 0
+	}
+}
+
+// retryDelay returns the delay carried by the RetryInfo detail of err, if any.
+func retryDelay(err *connect.Error) time.Duration {
+	for _, detail := range err.Details() {
+		value, err := detail.Value()
+		if err != nil {
+			continue
+		}
+
+		if info, ok := value.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+
+	return 0
+}
+
+// wait sleeps for d, returning early with an error if ctx is done.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,166 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/image"
+
+	"go.uber.org/zap"
+)
+
+// Conflict reports a hash that has been found at several paths: only the first one (Paths[0]) is indexed.
+type Conflict struct {
+	Hash  []byte
+	Paths []string
+}
+
+// Report summarizes the outcome of rebuilding the index.
+type Report struct {
+	// Indexed is the number of files stored in the repository
+	Indexed int
+	// Unchanged is the number of files that were already indexed at the same path
+	Unchanged int
+	Conflicts []Conflict
+}
+
+type Indexer interface {
+	// Rebuild walks the archive rooted at archivePath, storing the media it contains in the repository
+	Rebuild(ctx context.Context, archivePath string) (*Report, error)
+}
+
+type indexer struct {
+	repo      db.Repository
+	fileTypes []string
+	logger    *zap.Logger
+}
+
+func NewIndexer(repo db.Repository, fileTypes []string, logger *zap.Logger) *indexer {
+	return &indexer{
+		repo:      repo,
+		fileTypes: fileTypes,
+		logger:    logger,
+	}
+}
+
+// Rebuild recomputes the hash and creation date of every file in the archive, skipping its staging area. Files that are
+// already indexed at another path that still exists are left untouched and reported as conflicts, as are files whose
+// content has been found earlier during the walk.
+func (i *indexer) Rebuild(ctx context.Context, archivePath string) (*Report, error) {
+	report := &Report{}
+	// paths found so far, by hash
+	found := make(map[string][]string)
+
+	// stop walking if returning early
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for m := range fs.Walk(walkCtx, archivePath, i.fileTypes, fs.WithExclude(filepath.Join(archivePath, "tmp"))) {
+		if m.Err != nil {
+			return nil, m.Err
+		}
+
+		key := string(m.Hash)
+		if slices.Contains(found[key], m.Path) {
+			// already indexed at this path, as reported when its content was first found
+			continue
+		}
+
+		found[key] = append(found[key], m.Path)
+		if len(found[key]) > 1 {
+			continue
+		}
+
+		indexed, err := i.index(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("unable to index %v: %w", m.Path, err)
+		}
+
+		if indexed == "" {
+			report.Indexed++
+			i.logger.Info("Indexed file", zap.String("path", m.Path))
+		} else if indexed == m.Path {
+			report.Unchanged++
+		} else {
+			found[key] = append([]string{indexed}, found[key]...)
+		}
+	}
+
+	// the walk stops short, without errors, if ctx is done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for key, paths := range found {
+		if len(paths) > 1 {
+			report.Conflicts = append(report.Conflicts, Conflict{Hash: []byte(key), Paths: paths})
+		}
+	}
+	sort.Slice(report.Conflicts, func(a, b int) bool {
+		return report.Conflicts[a].Paths[0] < report.Conflicts[b].Paths[0]
+	})
+
+	for _, c := range report.Conflicts {
+		i.logger.Warn("Found the same file at several paths", zap.String("indexed", c.Paths[0]), zap.Strings("others", c.Paths[1:]))
+	}
+
+	return report, nil
+}
+
+// index stores the media, unless it is already indexed at a path that still exists: in that case, it returns that path
+// and only makes sure that the stored media is in the date indexes, which media stored by earlier versions are not.
+func (i *indexer) index(ctx context.Context, m db.Media) (string, error) {
+	existing, err := i.repo.Get(ctx, m.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	if existing != nil {
+		stat, err := os.Stat(existing.Path)
+		if err == nil {
+			if existing.ImportedAt == nil {
+				// the modification time of an archived file is the time it was received
+				importedAt := stat.ModTime()
+				existing.ImportedAt = &importedAt
+			}
+
+			return existing.Path, i.repo.Index(ctx, *existing)
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	stat, err := os.Stat(m.Path)
+	if err != nil {
+		return "", err
+	}
+
+	createdAt, err := image.ParseCreatedAt(m.Path)
+	if err != nil {
+		var notFound image.ErrNotFound
+		if !errors.As(err, &notFound) {
+			return "", fmt.Errorf("unable to parse createdAt: %w", err)
+		}
+
+		// the original modification time is lost: the time the file was archived is the closest approximation
+		createdAt = m.CreatedAt
+	}
+
+	// the modification time of an archived file is the time it was received
+	importedAt := m.CreatedAt
+
+	return "", i.repo.Store(ctx, db.Media{
+		Hash:       m.Hash,
+		Path:       m.Path,
+		CreatedAt:  createdAt,
+		ImportedAt: &importedAt,
+		Size:       stat.Size(),
+	})
+}
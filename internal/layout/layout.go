@@ -0,0 +1,267 @@
+package layout
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fedragon/ark/internal/image"
+)
+
+// DefaultTemplate archives files by creation date, keeping their original name.
+const DefaultTemplate = "{year}/{month}/{day}"
+
+// Default is the layout described by DefaultTemplate.
+var Default = MustParse(DefaultTemplate)
+
+// Attributes are the properties of a file that can be referenced in a template.
+type Attributes struct {
+	// Name is the original name of the file, including its extension
+	Name        string
+	Hash        []byte
+	CreatedAt   time.Time
+	CameraModel string
+}
+
+const unknown = "unknown"
+
+var placeholders = map[string]func(a Attributes) string{
+	"year":     func(a Attributes) string { return a.CreatedAt.Format("2006") },
+	"month":    func(a Attributes) string { return a.CreatedAt.Format("01") },
+	"day":      func(a Attributes) string { return a.CreatedAt.Format("02") },
+	"yyyymmdd": func(a Attributes) string { return a.CreatedAt.Format("20060102") },
+	"hhmmss":   func(a Attributes) string { return a.CreatedAt.Format("150405") },
+	"hash8": func(a Attributes) string {
+		h := hex.EncodeToString(a.Hash)
+		return h[:min(8, len(h))]
+	},
+	"name":         func(a Attributes) string { return sanitize(strings.TrimSuffix(a.Name, filepath.Ext(a.Name))) },
+	"ext":          func(a Attributes) string { return replaceSeparators(filepath.Ext(a.Name)) },
+	"camera_model": func(a Attributes) string { return sanitize(a.CameraModel) },
+	"media_type":   func(a Attributes) string { return MediaType(a.Name) },
+}
+
+var mediaTypes = map[string]string{
+	".cr2":  "image",
+	".orf":  "image",
+	".heic": "image",
+	".jpg":  "image",
+	".jpeg": "image",
+	".png":  "image",
+	".tiff": "image",
+	".avi":  "video",
+	".mov":  "video",
+	".mp4":  "video",
+	".mpg":  "video",
+	".mpeg": "video",
+	".wmv":  "video",
+}
+
+// MediaType returns the type of media ("image", "video" or "other") of a file, based on its extension.
+func MediaType(name string) string {
+	if t, ok := mediaTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return t
+	}
+
+	return "other"
+}
+
+type token struct {
+	literal     string
+	placeholder string
+}
+
+// Layout describes where files are stored in the archive, relative to its root. It is built from a template made of
+// '/'-separated path elements, each of which may reference placeholders such as {year} or {camera_model}: if the last
+// element references {ext}, it describes the file name too, otherwise files keep their original name.
+type Layout struct {
+	template string
+	elements [][]token
+	uses     map[string]struct{}
+}
+
+// Parse validates the template and returns the corresponding Layout.
+func Parse(template string) (*Layout, error) {
+	if template == "" {
+		return nil, errors.New("empty layout template")
+	}
+
+	if strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("layout template must be relative: %v", template)
+	}
+
+	l := &Layout{template: template, uses: make(map[string]struct{})}
+	for _, element := range strings.Split(template, "/") {
+		if element == "" || element == "." || element == ".." {
+			return nil, fmt.Errorf("invalid path element %q in layout template: %v", element, template)
+		}
+
+		tokens, err := tokenize(element)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layout template %v: %w", template, err)
+		}
+
+		for _, t := range tokens {
+			if t.placeholder != "" {
+				l.uses[t.placeholder] = struct{}{}
+			}
+		}
+
+		l.elements = append(l.elements, tokens)
+	}
+
+	return l, nil
+}
+
+// MustParse is like Parse but panics if the template is invalid.
+func MustParse(template string) *Layout {
+	l, err := Parse(template)
+	if err != nil {
+		panic(err)
+	}
+
+	return l
+}
+
+func tokenize(element string) ([]token, error) {
+	var tokens []token
+	for element != "" {
+		start := strings.IndexAny(element, "{}")
+		if start == -1 {
+			tokens = append(tokens, token{literal: element})
+			break
+		}
+
+		if element[start] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in %q", element)
+		}
+
+		if start > 0 {
+			tokens = append(tokens, token{literal: element[:start]})
+		}
+
+		end := strings.IndexByte(element[start:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed '{' in %q", element)
+		}
+
+		name := element[start+1 : start+end]
+		if _, ok := placeholders[name]; !ok {
+			return nil, fmt.Errorf("unknown placeholder {%v}", name)
+		}
+
+		tokens = append(tokens, token{placeholder: name})
+		element = element[start+end+1:]
+	}
+
+	return tokens, nil
+}
+
+// String returns the template the layout has been parsed from.
+func (l *Layout) String() string {
+	return l.template
+}
+
+// Uses reports whether the layout references the given placeholder (e.g. "camera_model").
+func (l *Layout) Uses(placeholder string) bool {
+	_, ok := l.uses[placeholder]
+	return ok
+}
+
+// Resolve returns the directory (relative to the root of the archive) and the name of the file with the given
+// attributes.
+func (l *Layout) Resolve(a Attributes) (string, string) {
+	resolved := make([]string, len(l.elements))
+	for i, tokens := range l.elements {
+		var sb strings.Builder
+		for _, t := range tokens {
+			if t.placeholder == "" {
+				sb.WriteString(t.literal)
+				continue
+			}
+
+			sb.WriteString(placeholders[t.placeholder](a))
+		}
+
+		// values are sanitized one by one, but could still add up to a relative path element (e.g. "{ext}.")
+		resolved[i] = sb.String()
+		if resolved[i] == "" || resolved[i] == "." || resolved[i] == ".." {
+			resolved[i] = unknown
+		}
+	}
+
+	if containsExt(l.elements[len(l.elements)-1]) {
+		return filepath.Join(resolved[:len(resolved)-1]...), resolved[len(resolved)-1]
+	}
+
+	return filepath.Join(resolved...), sanitize(a.Name)
+}
+
+// ReadAttributes returns the attributes of the file at path, originally called name, as referenced by the layout: its
+// creation date (and camera model) is extracted from the file itself whenever possible, falling back to createdAt.
+func (l *Layout) ReadAttributes(path, name string, hash []byte, createdAt time.Time) (Attributes, error) {
+	attrs := Attributes{
+		Name:      filepath.Base(name),
+		Hash:      hash,
+		CreatedAt: createdAt,
+	}
+
+	parsed, err := image.ParseCreatedAt(path)
+	if err == nil {
+		attrs.CreatedAt = parsed
+	} else {
+		var notFound image.ErrNotFound
+		if !errors.As(err, &notFound) {
+			return Attributes{}, fmt.Errorf("unable to parse createdAt: %w", err)
+		}
+	}
+
+	if l.Uses("camera_model") {
+		model, err := image.ParseCameraModel(path)
+		if err != nil {
+			var notFound image.ErrNotFound
+			if !errors.As(err, &notFound) {
+				return Attributes{}, fmt.Errorf("unable to parse camera model: %w", err)
+			}
+		}
+
+		attrs.CameraModel = model
+	}
+
+	return attrs, nil
+}
+
+func containsExt(tokens []token) bool {
+	for _, t := range tokens {
+		if t.placeholder == "ext" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitize makes a free-form value (e.g. a camera model) safe to use as a path element.
+func sanitize(value string) string {
+	value = replaceSeparators(strings.TrimSpace(strings.Trim(value, "\x00")))
+
+	if value == "" || value == "." || value == ".." {
+		return unknown
+	}
+
+	return value
+}
+
+// replaceSeparators replaces the characters that separate path elements (on any platform) in value.
+func replaceSeparators(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':':
+			return '_'
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,155 @@
+package layout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		valid    bool
+	}{
+		{
+			name:     "the default template is valid",
+			template: DefaultTemplate,
+			valid:    true,
+		},
+		{
+			name:     "a template with literals and a file name pattern is valid",
+			template: "{media_type}/{year}/{year}-{month}/{yyyymmdd}_{hhmmss}_{hash8}{ext}",
+			valid:    true,
+		},
+		{
+			name:     "an empty template is invalid",
+			template: "",
+			valid:    false,
+		},
+		{
+			name:     "an absolute template is invalid",
+			template: "/{year}",
+			valid:    false,
+		},
+		{
+			name:     "a template escaping the archive is invalid",
+			template: "{year}/../{month}",
+			valid:    false,
+		},
+		{
+			name:     "a template with an empty path element is invalid",
+			template: "{year}//{month}",
+			valid:    false,
+		},
+		{
+			name:     "a template with an unknown placeholder is invalid",
+			template: "{year}/{week}",
+			valid:    false,
+		},
+		{
+			name:     "a template with an unclosed placeholder is invalid",
+			template: "{year}/{month",
+			valid:    false,
+		},
+		{
+			name:     "a template with an unopened placeholder is invalid",
+			template: "{year}/month}",
+			valid:    false,
+		},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.template)
+		if (err == nil) != c.valid {
+			t.Errorf("%v\n\tExpected valid to be %v but got error %v instead", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestLayout_Resolve(t *testing.T) {
+	attrs := Attributes{
+		Name:        "IMG_0001.JPG",
+		Hash:        []byte{0x1a, 0x2b, 0x3c, 0x4d, 0x5e, 0x6f},
+		CreatedAt:   time.Date(2019, 3, 14, 15, 9, 26, 0, time.UTC),
+		CameraModel: "Canon EOS 5D Mark II\x00",
+	}
+
+	cases := []struct {
+		name         string
+		template     string
+		attrs        Attributes
+		expectedDir  string
+		expectedName string
+	}{
+		{
+			name:         "the default template archives files by creation date",
+			template:     DefaultTemplate,
+			attrs:        attrs,
+			expectedDir:  "2019/03/14",
+			expectedName: "IMG_0001.JPG",
+		},
+		{
+			name:         "literals are kept as they are",
+			template:     "{year}/{year}-{month}",
+			attrs:        attrs,
+			expectedDir:  "2019/2019-03",
+			expectedName: "IMG_0001.JPG",
+		},
+		{
+			name:         "camera model and media type are resolved",
+			template:     "{media_type}/{camera_model}",
+			attrs:        attrs,
+			expectedDir:  "image/Canon EOS 5D Mark II",
+			expectedName: "IMG_0001.JPG",
+		},
+		{
+			name:         "a missing camera model is resolved as unknown",
+			template:     "{camera_model}",
+			attrs:        Attributes{Name: "clip.mov"},
+			expectedDir:  "unknown",
+			expectedName: "clip.mov",
+		},
+		{
+			name:         "a last path element referencing the extension describes the file name",
+			template:     "{year}/{yyyymmdd}_{hhmmss}_{hash8}{ext}",
+			attrs:        attrs,
+			expectedDir:  "2019",
+			expectedName: "20190314_150926_1a2b3c4d.JPG",
+		},
+		{
+			name:         "names cannot escape their directory",
+			template:     "{year}/{name}/{name}{ext}",
+			attrs:        Attributes{Name: "..", CreatedAt: attrs.CreatedAt},
+			expectedDir:  "2019/unknown",
+			expectedName: "unknown.",
+		},
+		{
+			name:         "separators in names are replaced",
+			template:     "{name}/{hash8}{ext}",
+			attrs:        Attributes{Name: `..\..\evil.jpg`, Hash: attrs.Hash},
+			expectedDir:  ".._.._evil",
+			expectedName: "1a2b3c4d.jpg",
+		},
+		{
+			name:         "original names are sanitized too",
+			template:     "{year}",
+			attrs:        Attributes{Name: "..", CreatedAt: attrs.CreatedAt},
+			expectedDir:  "2019",
+			expectedName: "unknown",
+		},
+		{
+			name:         "values cannot add up to a relative path element",
+			template:     "{ext}.",
+			attrs:        Attributes{Name: "a."},
+			expectedDir:  "",
+			expectedName: "unknown",
+		},
+	}
+
+	for _, c := range cases {
+		dir, name := MustParse(c.template).Resolve(c.attrs)
+		if dir != c.expectedDir || name != c.expectedName {
+			t.Errorf("%v\n\tExpected %v, %v but got %v, %v instead", c.name, c.expectedDir, c.expectedName, dir, name)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/auth"
+
+	"connectrpc.com/connect"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// concurrencyRetryDelay is how long clients are told to wait before retrying an upload rejected because they already
+// have too many uploads in progress
+const concurrencyRetryDelay = 5 * time.Second
+
+// evictionInterval is how often clients that are no longer limited in any way are forgotten
+const evictionInterval = time.Minute
+
+// Limits are enforced on the uploads of each client (i.e. subject) separately, except for the clients signing their
+// tokens with the shared key, which share the same limits: zero means unlimited.
+type Limits struct {
+	// MaxConcurrentUploads is how many files a client can upload at the same time
+	MaxConcurrentUploads int
+	// BytesPerSecond is how fast a client can upload, across all its uploads: faster clients are slowed down
+	BytesPerSecond int64
+	// Quota is how many bytes a client can store in the archive, overall
+	Quota int64
+}
+
+// Usage keeps track of the storage used by each client.
+type Usage interface {
+	AddUsage(ctx context.Context, subject string, bytes int64) error
+	ReserveUsage(ctx context.Context, subject string, bytes, quota int64) (int64, bool, error)
+}
+
+// Interceptor enforces Limits on the UploadFile streams of each client, as identified by auth.FromContext: it must
+// therefore run after the authentication interceptor. Requests beyond the limits fail with CodeResourceExhausted,
+// carrying a RetryInfo detail when retrying later might succeed.
+type Interceptor struct {
+	limits Limits
+	usage  Usage
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	evictedAt time.Time
+}
+
+type client struct {
+	uploads int
+	limiter *rate.Limiter
+}
+
+func NewInterceptor(limits Limits, usage Usage) *Interceptor {
+	return &Interceptor{
+		limits:  limits,
+		usage:   usage,
+		clients: make(map[string]*client),
+	}
+}
+
+func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		if conn.Spec().Procedure != arkv1connect.ArkApiUploadFileProcedure {
+			return next(ctx, conn)
+		}
+
+		id, ok := auth.FromContext(ctx)
+		if !ok {
+			return connect.NewError(connect.CodeUnauthenticated, errors.New("unknown client"))
+		}
+
+		// clients signing their tokens with the shared key may claim any subject, and would therefore dodge their limits
+		subject := id.Subject
+		if !id.OwnKey {
+			subject = auth.SharedSubject
+		}
+
+		c, err := i.acquire(subject)
+		if err != nil {
+			return err
+		}
+		defer i.release(subject)
+
+		// the first message carries the size of the file, which is needed to enforce the quota
+		first := new(arkv1.UploadFileRequest)
+		lc := &limitedConn{
+			StreamingHandlerConn: conn,
+			ctx:                  ctx,
+			limiter:              c.limiter,
+			first:                first,
+			firstErr:             conn.Receive(first),
+		}
+		size := first.GetMetadata().GetSize()
+
+		if lc.firstErr != nil {
+			return next(ctx, lc)
+		}
+
+		// the bytes are reserved before the upload, so that concurrent uploads cannot exceed the quota together
+		used, ok, err := i.usage.ReserveUsage(ctx, subject, size, i.limits.Quota)
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+
+		if !ok {
+			return exhausted(fmt.Errorf("storage quota exceeded: %v of %v bytes used", used, i.limits.Quota), 0)
+		}
+
+		if err := next(ctx, lc); err != nil {
+			// best effort: at worst, the client is left with less storage than it is entitled to
+			_ = i.usage.AddUsage(context.WithoutCancel(ctx), subject, -size)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// acquire registers a new upload of the subject, failing if it already has too many uploads in progress.
+func (i *Interceptor) acquire(subject string) (*client, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// clients that are left with some bandwidth to recover when their last upload completes are evicted later on
+	if now := time.Now(); now.Sub(i.evictedAt) >= evictionInterval {
+		i.evictIdle(now)
+	}
+
+	c, ok := i.clients[subject]
+	if !ok {
+		c = &client{}
+		if i.limits.BytesPerSecond > 0 {
+			// allow bursts of up to one second worth of data
+			c.limiter = rate.NewLimiter(rate.Limit(i.limits.BytesPerSecond), int(i.limits.BytesPerSecond))
+		}
+		i.clients[subject] = c
+	}
+
+	if i.limits.MaxConcurrentUploads > 0 && c.uploads >= i.limits.MaxConcurrentUploads {
+		return nil, exhausted(fmt.Errorf("too many concurrent uploads: at most %v allowed", i.limits.MaxConcurrentUploads), concurrencyRetryDelay)
+	}
+
+	c.uploads++
+	return c, nil
+}
+
+func (i *Interceptor) release(subject string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c := i.clients[subject]
+	c.uploads--
+
+	// clients are kept around as long as they are limited, so that their bandwidth cannot be reset by opening a new
+	// stream
+	if c.idle(time.Now()) {
+		delete(i.clients, subject)
+	}
+}
+
+// evictIdle forgets the clients that are no longer limited in any way.
+func (i *Interceptor) evictIdle(now time.Time) {
+	for subject, c := range i.clients {
+		if c.idle(now) {
+			delete(i.clients, subject)
+		}
+	}
+	i.evictedAt = now
+}
+
+// idle reports whether the client has no upload in progress and its full bandwidth available, i.e. whether forgetting
+// it would make no difference.
+func (c *client) idle(now time.Time) bool {
+	return c.uploads == 0 && (c.limiter == nil || c.limiter.TokensAt(now) >= float64(c.limiter.Burst()))
+}
+
+// limitedConn replays the first message, which has already been received by the interceptor, and slows down the
+// reception of the following ones to the rate allowed by limiter (if not nil).
+type limitedConn struct {
+	connect.StreamingHandlerConn
+
+	ctx      context.Context
+	limiter  *rate.Limiter
+	first    *arkv1.UploadFileRequest
+	firstErr error
+}
+
+func (c *limitedConn) Receive(msg any) error {
+	if c.first != nil {
+		first, err := c.first, c.firstErr
+		c.first, c.firstErr = nil, nil
+		if err != nil {
+			return err
+		}
+
+		m, ok := msg.(proto.Message)
+		if !ok {
+			return fmt.Errorf("unexpected message type: %T", msg)
+		}
+		proto.Reset(m)
+		proto.Merge(m, first)
+
+		return nil
+	}
+
+	if err := c.StreamingHandlerConn.Receive(msg); err != nil {
+		return err
+	}
+
+	req, ok := msg.(*arkv1.UploadFileRequest)
+	if !ok || c.limiter == nil {
+		return nil
+	}
+
+	// chunks may be larger than the burst the limiter allows
+	for n := len(req.GetChunk().GetData()); n > 0; n -= c.limiter.Burst() {
+		if err := c.limiter.WaitN(c.ctx, min(n, c.limiter.Burst())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exhausted returns a CodeResourceExhausted error, telling the client to retry after the given delay if not zero.
+func exhausted(err error, retryDelay time.Duration) error {
+	cerr := connect.NewError(connect.CodeResourceExhausted, err)
+	if retryDelay <= 0 {
+		return cerr
+	}
+
+	if detail, err := connect.NewErrorDetail(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)}); err == nil {
+		cerr.AddDetail(detail)
+	}
+
+	return cerr
+}
@@ -0,0 +1,329 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/auth"
+
+	"connectrpc.com/connect"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+const (
+	subjectHeader = "Subject"
+	holdName      = "hold.jpg"
+	failName      = "fail.jpg"
+	// sharedPrefix marks the subjects of clients signing their tokens with the shared key
+	sharedPrefix = "shared-"
+)
+
+type usage struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}
+
+func (u *usage) AddUsage(_ context.Context, subject string, bytes int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.bytes[subject] += bytes
+	return nil
+}
+
+func (u *usage) ReserveUsage(_ context.Context, subject string, bytes, quota int64) (int64, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if quota > 0 && u.bytes[subject]+bytes > quota {
+		return u.bytes[subject], false, nil
+	}
+
+	u.bytes[subject] += bytes
+	return u.bytes[subject], true, nil
+}
+
+func (u *usage) Usage(_ context.Context, subject string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.bytes[subject], nil
+}
+
+// handler drains uploads, blocking the ones of files named holdName on hold once it has received their metadata, and
+// failing the ones of files named failName.
+type handler struct {
+	received chan struct{}
+	hold     chan struct{}
+
+	arkv1connect.UnimplementedArkApiHandler
+}
+
+func (h *handler) UploadFile(_ context.Context, req *connect.ClientStream[arkv1.UploadFileRequest]) (*connect.Response[arkv1.UploadFileResponse], error) {
+	if !req.Receive() || req.Msg().GetMetadata() == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("expected metadata"))
+	}
+
+	name := req.Msg().GetMetadata().GetName()
+	if name == holdName {
+		h.received <- struct{}{}
+		<-h.hold
+	}
+
+	for req.Receive() {
+	}
+
+	if name == failName {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("upload failed"))
+	}
+
+	return connect.NewResponse(&arkv1.UploadFileResponse{}), req.Err()
+}
+
+// identity stands in for the authentication interceptor, taking the subject (if any) from a request header.
+type identity struct{}
+
+func (identity) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (identity) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (identity) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		subject := conn.RequestHeader().Get(subjectHeader)
+		if subject == "" {
+			return next(ctx, conn)
+		}
+
+		return next(auth.NewContext(ctx, auth.Identity{Subject: subject, OwnKey: !strings.HasPrefix(subject, sharedPrefix)}), conn)
+	}
+}
+
+func newClient(t *testing.T, h *handler, limits Limits, u *usage) arkv1connect.ArkApiClient {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.Handle(arkv1connect.NewArkApiHandler(h, connect.WithInterceptors(identity{}, NewInterceptor(limits, u))))
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return arkv1connect.NewArkApiClient(srv.Client(), srv.URL)
+}
+
+func upload(ctx context.Context, client arkv1connect.ArkApiClient, subject string, data []byte) error {
+	return uploadFile(ctx, client, subject, "image.jpg", data)
+}
+
+func uploadFile(ctx context.Context, client arkv1connect.ArkApiClient, subject, name string, data []byte) error {
+	stream := client.UploadFile(ctx)
+	stream.RequestHeader().Set(subjectHeader, subject)
+
+	err := stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: &arkv1.Metadata{Name: name, Size: int64(len(data))},
+		},
+	})
+	if err == nil && len(data) > 0 {
+		err = stream.Send(&arkv1.UploadFileRequest{
+			File: &arkv1.UploadFileRequest_Chunk{Chunk: &arkv1.Chunk{Data: data}},
+		})
+	}
+
+	// the error of the response is more telling than the one of the request, if any
+	if _, cerr := stream.CloseAndReceive(); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+func assertExhausted(t *testing.T, err error, wantRetryInfo bool) {
+	t.Helper()
+
+	if connect.CodeOf(err) != connect.CodeResourceExhausted {
+		t.Fatalf("expected %v, got %v", connect.CodeResourceExhausted, err)
+	}
+
+	var cerr *connect.Error
+	errors.As(err, &cerr)
+
+	var hasRetryInfo bool
+	for _, detail := range cerr.Details() {
+		value, err := detail.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info, ok := value.(*errdetails.RetryInfo); ok {
+			hasRetryInfo = info.GetRetryDelay().AsDuration() > 0
+		}
+	}
+
+	if hasRetryInfo != wantRetryInfo {
+		t.Errorf("expected retry info: %v, got: %v", wantRetryInfo, hasRetryInfo)
+	}
+}
+
+func TestInterceptor_LimitsConcurrentUploads(t *testing.T) {
+	h := &handler{received: make(chan struct{}), hold: make(chan struct{})}
+	client := newClient(t, h, Limits{MaxConcurrentUploads: 1}, &usage{bytes: map[string]int64{}})
+
+	pending := make(chan error, 1)
+	go func() {
+		pending <- uploadFile(context.Background(), client, "laptop", holdName, []byte("first"))
+	}()
+	<-h.received
+
+	assertExhausted(t, upload(context.Background(), client, "laptop", []byte("second")), true)
+
+	if err := upload(context.Background(), client, "phone", []byte("other client")); err != nil {
+		t.Errorf("upload() of another client error = %v", err)
+	}
+
+	close(h.hold)
+	if err := <-pending; err != nil {
+		t.Errorf("pending upload() error = %v", err)
+	}
+}
+
+func TestInterceptor_EnforcesQuota(t *testing.T) {
+	u := &usage{bytes: map[string]int64{"laptop": 60}}
+	client := newClient(t, &handler{}, Limits{Quota: 100}, u)
+
+	assertExhausted(t, upload(context.Background(), client, "laptop", make([]byte, 50)), false)
+
+	if err := upload(context.Background(), client, "laptop", make([]byte, 40)); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+
+	if used, _ := u.Usage(context.Background(), "laptop"); used != 100 {
+		t.Errorf("expected 100 bytes used, got %v", used)
+	}
+}
+
+func TestInterceptor_ReservesQuotaOfConcurrentUploads(t *testing.T) {
+	h := &handler{received: make(chan struct{}), hold: make(chan struct{})}
+	u := &usage{bytes: map[string]int64{}}
+	client := newClient(t, h, Limits{Quota: 100}, u)
+
+	pending := make(chan error, 1)
+	go func() {
+		pending <- uploadFile(context.Background(), client, "laptop", holdName, make([]byte, 60))
+	}()
+	<-h.received
+
+	// the first upload has not completed yet, but its bytes already count
+	assertExhausted(t, upload(context.Background(), client, "laptop", make([]byte, 60)), false)
+
+	close(h.hold)
+	if err := <-pending; err != nil {
+		t.Errorf("pending upload() error = %v", err)
+	}
+
+	if used, _ := u.Usage(context.Background(), "laptop"); used != 60 {
+		t.Errorf("expected 60 bytes used, got %v", used)
+	}
+}
+
+func TestInterceptor_ReleasesQuotaOfFailedUploads(t *testing.T) {
+	u := &usage{bytes: map[string]int64{"laptop": 10}}
+	client := newClient(t, &handler{}, Limits{Quota: 100}, u)
+
+	if err := uploadFile(context.Background(), client, "laptop", failName, make([]byte, 50)); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+
+	if used, _ := u.Usage(context.Background(), "laptop"); used != 10 {
+		t.Errorf("expected 10 bytes used, got %v", used)
+	}
+}
+
+func TestInterceptor_LimitsBandwidth(t *testing.T) {
+	client := newClient(t, &handler{}, Limits{BytesPerSecond: 1000}, &usage{bytes: map[string]int64{}})
+
+	// the first second worth of data is let through straight away
+	start := time.Now()
+	if err := upload(context.Background(), client, "laptop", make([]byte, 1500)); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the upload to be slowed down, took %v", elapsed)
+	}
+}
+
+func TestInterceptor_RejectsUnknownClients(t *testing.T) {
+	client := newClient(t, &handler{}, Limits{}, &usage{bytes: map[string]int64{}})
+
+	if err := upload(context.Background(), client, "", []byte("anonymous")); connect.CodeOf(err) != connect.CodeUnauthenticated {
+		t.Errorf("expected %v, got %v", connect.CodeUnauthenticated, err)
+	}
+}
+
+func TestInterceptor_SharesLimitsOfSharedKeyClients(t *testing.T) {
+	h := &handler{received: make(chan struct{}), hold: make(chan struct{})}
+	client := newClient(t, h, Limits{MaxConcurrentUploads: 1}, &usage{bytes: map[string]int64{}})
+
+	pending := make(chan error, 1)
+	go func() {
+		pending <- uploadFile(context.Background(), client, sharedPrefix+"laptop", holdName, []byte("first"))
+	}()
+	<-h.received
+
+	// claiming another subject does not help
+	assertExhausted(t, upload(context.Background(), client, sharedPrefix+"phone", []byte("second")), true)
+
+	if err := upload(context.Background(), client, "phone", []byte("own key")); err != nil {
+		t.Errorf("upload() of a client with its own key error = %v", err)
+	}
+
+	close(h.hold)
+	if err := <-pending; err != nil {
+		t.Errorf("pending upload() error = %v", err)
+	}
+}
+
+func TestInterceptor_EvictsIdleClients(t *testing.T) {
+	i := NewInterceptor(Limits{BytesPerSecond: 1000}, &usage{bytes: map[string]int64{}})
+
+	c, err := i.acquire("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.limiter.AllowN(time.Now(), 1000)
+	i.release("laptop")
+
+	if _, ok := i.clients["laptop"]; !ok {
+		t.Fatal("expected a client with bandwidth to recover to be kept")
+	}
+
+	i.evictIdle(time.Now().Add(2 * time.Second))
+
+	if len(i.clients) != 0 {
+		t.Errorf("expected idle clients to be evicted, got %v", i.clients)
+	}
+
+	unlimited := NewInterceptor(Limits{MaxConcurrentUploads: 1}, &usage{bytes: map[string]int64{}})
+	if _, err := unlimited.acquire("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	unlimited.release("laptop")
+
+	if len(unlimited.clients) != 0 {
+		t.Errorf("expected the client to be evicted once its last upload completes, got %v", unlimited.clients)
+	}
+}
@@ -0,0 +1,138 @@
+package lister
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// Query selects the media whose date (created or imported, as per By) falls within [From, To): nil bounds leave the
+// range unbounded on that side.
+type Query struct {
+	By   arkv1.DateField
+	From *time.Time
+	To   *time.Time
+}
+
+type Lister interface {
+	// List writes all media selected by the query to w, in the given format
+	List(ctx context.Context, query Query, format string, w io.Writer) error
+}
+
+type lister struct {
+	client   arkv1connect.ArkApiClient
+	pageSize int32
+}
+
+func NewLister(client arkv1connect.ArkApiClient, pageSize int32) *lister {
+	return &lister{
+		client:   client,
+		pageSize: pageSize,
+	}
+}
+
+type item struct {
+	Hash       string     `json:"hash"`
+	Path       string     `json:"path"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ImportedAt *time.Time `json:"imported_at,omitempty"`
+}
+
+func (l *lister) List(ctx context.Context, query Query, format string, w io.Writer) error {
+	var write func(items []item) error
+	var flush func() error
+
+	switch format {
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(tw, "HASH\tPATH\tCREATED AT\tIMPORTED AT"); err != nil {
+			return err
+		}
+
+		write = func(items []item) error {
+			for _, i := range items {
+				importedAt := "-"
+				if i.ImportedAt != nil {
+					importedAt = i.ImportedAt.Format(time.RFC3339)
+				}
+
+				if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", i.Hash, i.Path, i.CreatedAt.Format(time.RFC3339), importedAt); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+		flush = tw.Flush
+	case FormatJSON:
+		all := make([]item, 0)
+		write = func(items []item) error {
+			all = append(all, items...)
+			return nil
+		}
+		flush = func() error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(all)
+		}
+	default:
+		return fmt.Errorf("unknown format: %v", format)
+	}
+
+	req := &arkv1.ListMediaRequest{
+		By:    query.By,
+		Limit: l.pageSize,
+	}
+	if query.From != nil {
+		req.From = timestamppb.New(*query.From)
+	}
+	if query.To != nil {
+		req.To = timestamppb.New(*query.To)
+	}
+
+	for {
+		res, err := l.client.ListMedia(ctx, connect.NewRequest(req))
+		if err != nil {
+			return err
+		}
+
+		items := make([]item, len(res.Msg.GetMedia()))
+		for i, m := range res.Msg.GetMedia() {
+			items[i] = item{
+				Hash:      hex.EncodeToString(m.GetHash()),
+				Path:      m.GetPath(),
+				CreatedAt: m.GetCreatedAt().AsTime(),
+			}
+			if m.GetImportedAt() != nil {
+				importedAt := m.GetImportedAt().AsTime()
+				items[i].ImportedAt = &importedAt
+			}
+		}
+
+		if err := write(items); err != nil {
+			return err
+		}
+
+		if res.Msg.GetNextCursor() == "" {
+			break
+		}
+		req.Cursor = res.Msg.GetNextCursor()
+	}
+
+	return flush()
+}
@@ -18,6 +18,28 @@ var (
 	TotalDuplicates = totals.With(p.Labels{"duplicate": "true"})
 	TotalImported   = totals.With(p.Labels{"duplicate": "false"})
 
+	scrubbed = promauto.NewCounterVec(
+		p.CounterOpts{
+			Name:      "scrubbed",
+			Namespace: "ark",
+			Help:      "The total number of archived files checked by scrubs, by outcome",
+		},
+		[]string{"result"},
+	)
+
+	TotalScrubbedOK        = scrubbed.With(p.Labels{"result": "ok"})
+	TotalScrubbedMissing   = scrubbed.With(p.Labels{"result": "missing"})
+	TotalScrubbedTruncated = scrubbed.With(p.Labels{"result": "truncated"})
+	TotalScrubbedCorrupted = scrubbed.With(p.Labels{"result": "corrupted"})
+
+	StagingReclaimedBytes = promauto.NewCounter(
+		p.CounterOpts{
+			Name:      "staging_reclaimed_bytes",
+			Namespace: "ark",
+			Help:      "The total number of bytes reclaimed by deleting orphaned files from the staging area",
+		},
+	)
+
 	duration = promauto.NewSummaryVec(
 		p.SummaryOpts{
 			Name:       "duration_ms",
@@ -27,8 +49,11 @@ var (
 		},
 		[]string{"operation"})
 
-	CopyFileDurationMs   = duration.With(p.Labels{"operation": "copy_file"})
-	GetDurationMs        = duration.With(p.Labels{"operation": "get"})
-	StoreDurationMs      = duration.With(p.Labels{"operation": "store"})
-	UploadFileDurationMs = duration.With(p.Labels{"operation": "upload_file"})
+	CopyFileDurationMs     = duration.With(p.Labels{"operation": "copy_file"})
+	DownloadFileDurationMs = duration.With(p.Labels{"operation": "download_file"})
+	GetDurationMs          = duration.With(p.Labels{"operation": "get"})
+	GetManyDurationMs      = duration.With(p.Labels{"operation": "get_many"})
+	ListDurationMs         = duration.With(p.Labels{"operation": "list"})
+	StoreDurationMs        = duration.With(p.Labels{"operation": "store"})
+	UploadFileDurationMs   = duration.With(p.Labels{"operation": "upload_file"})
 )
@@ -0,0 +1,111 @@
+package scrubber
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/metrics"
+
+	"go.uber.org/zap"
+)
+
+// ErrInProgress is returned when a scrub is requested while another one is still running.
+var ErrInProgress = errors.New("scrub already in progress")
+
+// Report lists the archived files that did not pass the check.
+type Report struct {
+	// Checked is the number of media that have been checked
+	Checked int
+	// Missing are the media whose file no longer exists
+	Missing []db.Media
+	// Truncated are the media whose file is smaller than it was when it was imported
+	Truncated []db.Media
+	// Corrupted are the media whose file content no longer matches their hash
+	Corrupted []db.Media
+}
+
+type Scrubber interface {
+	// Scrub checks that the file of every media in the repository still exists and still matches its hash
+	Scrub(ctx context.Context) (*Report, error)
+}
+
+type scrubber struct {
+	repo    db.Repository
+	logger  *zap.Logger
+	running atomic.Bool
+}
+
+func NewScrubber(repo db.Repository, logger *zap.Logger) *scrubber {
+	return &scrubber{
+		repo:   repo,
+		logger: logger,
+	}
+}
+
+// Scrub re-hashes every archived file, which may take a long time on large archives: only one scrub can run at a time.
+func (s *scrubber) Scrub(ctx context.Context) (*Report, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, ErrInProgress
+	}
+	defer s.running.Store(false)
+
+	report := &Report{}
+	err := s.repo.ForEach(ctx, func(m db.Media) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		report.Checked++
+
+		stat, err := os.Stat(m.Path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				s.logger.Error("Archived file is missing", zap.String("path", m.Path))
+				metrics.TotalScrubbedMissing.Inc()
+				report.Missing = append(report.Missing, m)
+				return nil
+			}
+			return fmt.Errorf("unable to check %v: %w", m.Path, err)
+		}
+
+		if m.Size > 0 && stat.Size() < m.Size {
+			s.logger.Error("Archived file is truncated", zap.String("path", m.Path), zap.Int64("expected_size", m.Size), zap.Int64("size", stat.Size()))
+			metrics.TotalScrubbedTruncated.Inc()
+			report.Truncated = append(report.Truncated, m)
+			return nil
+		}
+
+		hash, err := fs.Hash(m.Path)
+		if err != nil {
+			return fmt.Errorf("unable to hash %v: %w", m.Path, err)
+		}
+
+		if !bytes.Equal(hash, m.Hash) {
+			s.logger.Error("Archived file is corrupted", zap.String("path", m.Path))
+			metrics.TotalScrubbedCorrupted.Inc()
+			report.Corrupted = append(report.Corrupted, m)
+			return nil
+		}
+
+		metrics.TotalScrubbedOK.Inc()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Scrubbed archive",
+		zap.Int("checked", report.Checked),
+		zap.Int("missing", len(report.Missing)),
+		zap.Int("truncated", len(report.Truncated)),
+		zap.Int("corrupted", len(report.Corrupted)),
+	)
+
+	return report, nil
+}
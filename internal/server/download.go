@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/metrics"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const downloadChunkSize = 1024 * 1024
+
+// DownloadFile streams the archived file with the given hash: the first message carries its metadata, all the
+// following ones its content.
+func (s *Handler) DownloadFile(ctx context.Context, req *connect.Request[arkv1.DownloadFileRequest], stream *connect.ServerStream[arkv1.DownloadFileResponse]) error {
+	start := time.Now()
+	defer func() {
+		metrics.DownloadFileDurationMs.Observe(float64(time.Since(start).Milliseconds()))
+	}()
+
+	media, err := s.Repo.Get(ctx, req.Msg.GetHash())
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	if media == nil {
+		return connect.NewError(connect.CodeNotFound, fmt.Errorf("file not found: %x", req.Msg.GetHash()))
+	}
+
+	file, err := os.Open(media.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return connect.NewError(connect.CodeDataLoss, fmt.Errorf("archived file is missing: %v", media.Path))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	err = stream.Send(&arkv1.DownloadFileResponse{
+		File: &arkv1.DownloadFileResponse_Metadata{
+			Metadata: &arkv1.Metadata{
+				Hash:      media.Hash,
+				Name:      filepath.Base(media.Path),
+				Size:      stat.Size(),
+				CreatedAt: timestamppb.New(media.CreatedAt),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	chunk := make([]byte, downloadChunkSize)
+
+	for {
+		n, err := reader.Read(chunk)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return connect.NewError(connect.CodeInternal, err)
+		}
+
+		err = stream.Send(&arkv1.DownloadFileResponse{
+			File: &arkv1.DownloadFileResponse_Chunk{
+				Chunk: &arkv1.Chunk{
+					Data: chunk[:n],
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/auth"
+	"github.com/fedragon/ark/internal/db"
+
+	"connectrpc.com/connect"
+)
+
+// NewEnrollment creates a code that a client can enroll with, once and within ttl, as subject: the client is granted
+// the given scopes (the default ones if empty).
+func (s *Handler) NewEnrollment(ctx context.Context, subject string, scopes []string, ttl time.Duration) (string, error) {
+	if s.Keys == nil {
+		return "", errors.New("enrollment is not enabled")
+	}
+
+	if !auth.ValidKeyID(subject) {
+		return "", fmt.Errorf("invalid subject: %v", subject)
+	}
+
+	if len(scopes) == 0 {
+		scopes = auth.DefaultScopes
+	}
+
+	code, err := newEnrollmentCode()
+	if err != nil {
+		return "", err
+	}
+
+	enrollment := db.Enrollment{
+		Code:    code,
+		Subject: subject,
+		Scopes:  scopes,
+	}
+	if err := s.Repo.StoreEnrollment(ctx, enrollment, ttl); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// Enroll registers the public key of a client presenting a valid enrollment code: from now on, the client signs its
+// tokens with the corresponding private key, using the returned key id.
+func (s *Handler) Enroll(ctx context.Context, req *connect.Request[arkv1.EnrollRequest]) (*connect.Response[arkv1.EnrollResponse], error) {
+	if s.Keys == nil {
+		return nil, connect.NewError(connect.CodeUnimplemented, errors.New("enrollment is not enabled"))
+	}
+
+	publicKey, err := auth.ParsePublicKey(req.Msg.GetPublicKey())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	// consume the code only once the request is known to be valid, so that a client can fix its request and try again
+	enrollment, err := s.Repo.ConsumeEnrollment(ctx, req.Msg.GetCode())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if enrollment == nil {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid or expired enrollment code"))
+	}
+
+	if err := s.Keys.Register(enrollment.Subject, publicKey, enrollment.Scopes); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&arkv1.EnrollResponse{
+		KeyId:  enrollment.Subject,
+		Scopes: enrollment.Scopes,
+	}), nil
+}
+
+// newEnrollmentCode returns a random code that is easy enough to type (e.g. 16 upper case letters and digits).
+func newEnrollmentCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/fs"
+)
+
+// journalEntry records an import that is about to move a file into the archive: it is written (and flushed) before the
+// move and removed only once the media has been stored, so that an import interrupted in between (e.g. by a crash) can
+// be detected, and either completed or rolled back, on the next startup.
+type journalEntry struct {
+	// Media holds everything but the final path of the file
+	Media db.Media `json:"media"`
+	// TmpPath is the path of the file in the staging area
+	TmpPath string `json:"tmp_path"`
+	// Candidates are the paths the file may be moved to, in order of preference
+	Candidates []string `json:"candidates"`
+}
+
+func (s *Handler) journalDir() string {
+	return filepath.Join(s.ArchivePath, "tmp", "journal")
+}
+
+// journalPath returns the path of the journal entry for the given hash: only a prefix of the hash is used, since the
+// whole of it would make for a file name that is too long.
+func (s *Handler) journalPath(hash []byte) string {
+	return filepath.Join(s.journalDir(), hex.EncodeToString(hash[:min(32, len(hash))])+".json")
+}
+
+// writeJournal durably records the entry, replacing any previous one for the same hash.
+func (s *Handler) writeJournal(entry journalEntry) error {
+	dir := s.journalDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create journal subdirectory %v: %w", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create journal entry: %v", err)
+	}
+	name := f.Name()
+
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return fmt.Errorf("cannot write journal entry %q: %v", name, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return fmt.Errorf("cannot flush journal entry %q: %v", name, err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(name)
+		return fmt.Errorf("cannot close journal entry %q: %v", name, err)
+	}
+
+	if err := os.Rename(name, s.journalPath(entry.Media.Hash)); err != nil {
+		_ = os.Remove(name)
+		return fmt.Errorf("cannot write journal entry: %v", err)
+	}
+
+	return syncDir(dir)
+}
+
+// clearJournal removes the entry for the given hash, if any.
+func (s *Handler) clearJournal(hash []byte) error {
+	if err := os.Remove(s.journalPath(hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove journal entry: %v", err)
+	}
+
+	return nil
+}
+
+// Recover completes or rolls back the imports that were interrupted while moving files into the archive: if the file
+// made it into the archive, its media is stored; otherwise its staged content is discarded and the client will have to
+// upload it again. It must be called on startup, before serving any request.
+func (s *Handler) Recover(ctx context.Context) error {
+	entries, err := os.ReadDir(s.journalDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read journal: %w", err)
+	}
+
+	var errs []error
+	for _, e := range entries {
+		path := filepath.Join(s.journalDir(), e.Name())
+
+		if !strings.HasSuffix(e.Name(), ".json") {
+			// leftover of a journal entry that was never completely written
+			_ = os.Remove(path)
+			continue
+		}
+
+		if err := s.recoverEntry(ctx, path); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", e.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Handler) recoverEntry(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entry journalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		// the entry is flushed before the file is moved: a corrupted one means that the move never happened
+		return os.Remove(path)
+	}
+
+	media, err := s.Repo.Get(ctx, entry.Media.Hash)
+	if err != nil {
+		return err
+	}
+
+	if media == nil {
+		archived, err := findArchived(entry)
+		if err != nil {
+			return err
+		}
+
+		if archived != "" {
+			media := entry.Media
+			media.Path = archived
+			if err := s.Repo.Store(ctx, media); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Remove(entry.TmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := s.Repo.DeleteUploadSession(ctx, entry.Media.Hash); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// findArchived returns which of the candidate paths of the entry holds its content, or an empty string if none does.
+func findArchived(entry journalEntry) (string, error) {
+	for _, candidate := range entry.Candidates {
+		hash, err := fs.Hash(candidate)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+
+		if bytes.Equal(hash, entry.Media.Hash) {
+			return candidate, nil
+		}
+	}
+
+	return "", nil
+}
+
+// syncDir flushes the directory, so that the entries that have been added to (or removed from) it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("cannot flush directory %q: %v", dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/layout"
+
+	"connectrpc.com/connect"
+)
+
+// GetLayout returns the template describing where files are stored in the archive, so that clients can tell where
+// their files would land.
+func (s *Handler) GetLayout(_ context.Context, _ *connect.Request[arkv1.GetLayoutRequest]) (*connect.Response[arkv1.GetLayoutResponse], error) {
+	l := s.Layout
+	if l == nil {
+		l = layout.Default
+	}
+
+	return connect.NewResponse(&arkv1.GetLayoutResponse{Template: l.String()}), nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/db"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultListMediaLimit = 100
+	maxListMediaLimit     = 1000
+)
+
+// ListMedia returns the archived media created (or imported) within the given date range, sorted by that date.
+func (s *Handler) ListMedia(ctx context.Context, req *connect.Request[arkv1.ListMediaRequest]) (*connect.Response[arkv1.ListMediaResponse], error) {
+	query := db.ListQuery{
+		By:     db.CreatedAt,
+		Cursor: req.Msg.GetCursor(),
+		Limit:  int(req.Msg.GetLimit()),
+	}
+
+	switch req.Msg.GetBy() {
+	case arkv1.DateField_DATE_FIELD_UNSPECIFIED, arkv1.DateField_DATE_FIELD_CREATED_AT:
+	case arkv1.DateField_DATE_FIELD_IMPORTED_AT:
+		query.By = db.ImportedAt
+	default:
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unknown date field: %v", req.Msg.GetBy()))
+	}
+
+	if req.Msg.GetFrom() != nil {
+		query.From = req.Msg.GetFrom().AsTime()
+	}
+	if req.Msg.GetTo() != nil {
+		query.To = req.Msg.GetTo().AsTime()
+	}
+
+	if query.Limit < 0 || query.Limit > maxListMediaLimit {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid limit: expected at most %v, got %v", maxListMediaLimit, query.Limit))
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultListMediaLimit
+	}
+
+	media, cursor, err := s.Repo.List(ctx, query)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidCursor) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &arkv1.ListMediaResponse{
+		Media:      make([]*arkv1.Media, 0, len(media)),
+		NextCursor: cursor,
+	}
+	for _, m := range media {
+		res.Media = append(res.Media, toProtoMedia(m))
+	}
+
+	return connect.NewResponse(res), nil
+}
+
+func toProtoMedia(m db.Media) *arkv1.Media {
+	item := &arkv1.Media{
+		Hash:      m.Hash,
+		Path:      m.Path,
+		CreatedAt: timestamppb.New(m.CreatedAt),
+	}
+	if m.ImportedAt != nil {
+		item.ImportedAt = timestamppb.New(*m.ImportedAt)
+	}
+
+	return item
+}
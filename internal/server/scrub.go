@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/scrubber"
+
+	"connectrpc.com/connect"
+)
+
+// ScrubArchive checks that every archived file still exists and still matches its hash, returning the ones that do not.
+func (s *Handler) ScrubArchive(ctx context.Context, _ *connect.Request[arkv1.ScrubArchiveRequest]) (*connect.Response[arkv1.ScrubArchiveResponse], error) {
+	if s.Scrubber == nil {
+		return nil, connect.NewError(connect.CodeUnimplemented, errors.New("scrubbing is not enabled"))
+	}
+
+	report, err := s.Scrubber.Scrub(ctx)
+	if err != nil {
+		if errors.Is(err, scrubber.ErrInProgress) {
+			return nil, connect.NewError(connect.CodeAborted, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&arkv1.ScrubArchiveResponse{
+		Checked:   int64(report.Checked),
+		Missing:   toProtoMediaList(report.Missing),
+		Truncated: toProtoMediaList(report.Truncated),
+		Corrupted: toProtoMediaList(report.Corrupted),
+	}), nil
+}
+
+func toProtoMediaList(media []db.Media) []*arkv1.Media {
+	items := make([]*arkv1.Media, 0, len(media))
+	for _, m := range media {
+		items = append(items, toProtoMedia(m))
+	}
+
+	return items
+}
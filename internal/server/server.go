@@ -1,33 +1,94 @@
 package server
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	arkv1 "github.com/fedragon/ark/gen/ark/v1"
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/auth"
 	"github.com/fedragon/ark/internal/db"
-	"github.com/fedragon/ark/internal/image"
+	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/layout"
 	"github.com/fedragon/ark/internal/metrics"
+	"github.com/fedragon/ark/internal/scrubber"
 
 	"connectrpc.com/connect"
 )
 
+const (
+	// maxFindDuplicatesHashes is the maximum number of hashes that can be checked with a single FindDuplicates request
+	maxFindDuplicatesHashes = 1000
+
+	// reservationTTL is how long the hash of an upload stays reserved if the server does not extend the reservation
+	// (e.g. because it crashed)
+	reservationTTL = time.Minute
+
+	// maxCollisionCounter is how many files sharing both name and hash prefix can be told apart by a counter
+	maxCollisionCounter = 100
+
+	// maxNameLength is the maximum length of file names, in bytes, of most file systems
+	maxNameLength = 255
+)
+
 type Handler struct {
 	Repo        db.Repository
 	ArchivePath string
+	// Layout describes where files are stored in the archive; defaults to layout.Default
+	Layout *layout.Layout
+	// UploadSessionTTL is how long the partial content of an interrupted upload is kept; defaults to 24 hours
+	UploadSessionTTL time.Duration
+	// Scrubber checks the integrity of the archive; scrubbing is disabled if nil
+	Scrubber scrubber.Scrubber
+	// Keys receives the public keys of enrolled clients; enrollment is disabled if nil
+	Keys *auth.KeySet
+
+	inFlight inFlight
+	uploads  uploads
 
 	arkv1connect.UnimplementedArkApiHandler
 }
 
+// FindDuplicates returns which of the given hashes are already known, together with the archive path of their files.
+func (s *Handler) FindDuplicates(ctx context.Context, req *connect.Request[arkv1.FindDuplicatesRequest]) (*connect.Response[arkv1.FindDuplicatesResponse], error) {
+	hashes := req.Msg.GetHashes()
+	if len(hashes) > maxFindDuplicatesHashes {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("too many hashes: expected at most %v, got %v", maxFindDuplicatesHashes, len(hashes)))
+	}
+
+	media, err := s.Repo.GetMany(ctx, hashes)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// this is a read-only query (e.g. of a dry run, or retried): duplicates are only counted when their upload is rejected
+	duplicates := make([]*arkv1.Duplicate, 0, len(media))
+	for _, m := range media {
+		duplicates = append(duplicates, &arkv1.Duplicate{
+			Hash: m.Hash,
+			Path: m.Path,
+		})
+	}
+
+	return connect.NewResponse(&arkv1.FindDuplicatesResponse{Duplicates: duplicates}), nil
+}
+
 func (s *Handler) UploadFile(ctx context.Context, req *connect.ClientStream[arkv1.UploadFileRequest]) (*connect.Response[arkv1.UploadFileResponse], error) {
+	if !s.uploads.begin() {
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("server is shutting down"))
+	}
+	defer s.uploads.end()
+
 	start := time.Now()
 	defer func() {
 		metrics.UploadFileDurationMs.Observe(float64(time.Since(start).Milliseconds()))
@@ -53,119 +114,376 @@ func (s *Handler) UploadFile(ctx context.Context, req *connect.ClientStream[arkv
 		return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("file already exists: %v", media.Path))
 	}
 
+	// make sure nobody else uploads the same content at the same time
+	owner, err := newID()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if err := s.Repo.Reserve(ctx, metadata.GetHash(), owner, reservationTTL); err != nil {
+		switch {
+		case errors.Is(err, db.ErrAlreadyStored):
+			metrics.TotalDuplicates.Inc()
+			return nil, connect.NewError(connect.CodeAlreadyExists, errors.New("file already exists"))
+		case errors.Is(err, db.ErrAlreadyReserved):
+			return nil, connect.NewError(connect.CodeAborted, errors.New("the same file is being uploaded by someone else"))
+		default:
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+
+	committed := false
+	stop := s.keepReserved(ctx, metadata.GetHash(), owner)
+	defer func() {
+		stop()
+		if !committed {
+			_ = s.Repo.Release(context.WithoutCancel(ctx), metadata.GetHash(), owner)
+		}
+	}()
+
 	now := time.Now()
 	media = &db.Media{
 		Hash:       metadata.GetHash(),
 		Path:       metadata.GetName(),
 		CreatedAt:  metadata.GetCreatedAt().AsTime(),
 		ImportedAt: &now,
+		Size:       metadata.GetSize(),
 	}
 
-	buffer := bytes.Buffer{}
-	var size int64
-
-	next = req.Receive()
-	for next {
-		chunk := req.Msg().GetChunk()
-
-		n, err := buffer.Write(chunk.GetData())
-		if err != nil {
-			return nil, connect.NewError(connect.CodeInternal, err)
-		}
-		size += int64(n)
-
-		next = req.Receive()
+	var tmpPath string
+	var hash []byte
+	if metadata.GetSessionId() != "" {
+		tmpPath, hash, err = s.resumeFile(ctx, metadata, req)
+	} else {
+		tmpPath, hash, err = s.writeFile(filepath.Base(media.Path), metadata.GetSize(), req)
 	}
+	if err != nil {
+		return nil, asConnectError(connect.CodeInternal, err)
+	}
+	defer s.inFlight.remove(tmpPath)
 
-	if req.Err() != nil {
-		return nil, connect.NewError(connect.CodeInternal, req.Err())
+	discard := func() {
+		_ = os.Remove(tmpPath)
+		if metadata.GetSessionId() != "" {
+			_ = s.Repo.DeleteUploadSession(ctx, metadata.GetHash())
+		}
 	}
 
-	if size != metadata.GetSize() {
-		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("total size mismatch: expected %v, got %v", metadata.GetSize(), size))
+	if !bytes.Equal(hash, metadata.GetHash()) {
+		discard()
+		return nil, connect.NewError(connect.CodeDataLoss, fmt.Errorf("hash mismatch: expected %x, got %x", metadata.GetHash(), hash))
 	}
+	media.Hash = hash
 
-	newPath, err := s.copyFile(*media, buffer)
-	if err != nil {
+	if err := s.copyFile(media, tmpPath); err != nil {
+		discard()
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
-	media.Path = newPath
 	if err := s.Repo.Store(ctx, *media); err != nil {
+		// roll back, otherwise the archive would hold a file unknown to the repository: the journal entry is only
+		// cleared if that succeeds, so that it can be completed on the next startup otherwise
+		if os.Remove(media.Path) == nil {
+			_ = s.clearJournal(media.Hash)
+		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
+	committed = true
+
+	// a leftover entry is harmless: it will be cleared on the next startup
+	_ = s.clearJournal(media.Hash)
+
+	if metadata.GetSessionId() != "" {
+		// best effort: the file is safely archived by now, and a leftover session expires by itself
+		_ = s.Repo.DeleteUploadSession(ctx, metadata.GetHash())
+	}
 
 	metrics.TotalImported.Inc()
 
 	return connect.NewResponse(&arkv1.UploadFileResponse{}), nil
 }
 
-func (s *Handler) copyFile(m db.Media, buffer bytes.Buffer) (string, error) {
+// WaitForUploads waits for all UploadFile calls in progress to either complete or roll back, or for ctx to be done:
+// new uploads are rejected from then on.
+func (s *Handler) WaitForUploads(ctx context.Context) error {
+	return s.uploads.wait(ctx)
+}
+
+// uploads tracks the UploadFile calls in progress, so that shutdown can wait for them to complete or roll back.
+type uploads struct {
+	mu       sync.Mutex
+	count    int
+	draining bool
+	// drained is closed once draining and no upload is left
+	drained chan struct{}
+}
+
+// begin registers a new upload, unless draining.
+func (u *uploads) begin() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.draining {
+		return false
+	}
+
+	u.count++
+	return true
+}
+
+func (u *uploads) end() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.count--
+	if u.draining && u.count == 0 {
+		close(u.drained)
+	}
+}
+
+func (u *uploads) wait(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.draining {
+		u.draining = true
+		u.drained = make(chan struct{})
+		if u.count == 0 {
+			close(u.drained)
+		}
+	}
+	drained := u.drained
+	u.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// keepReserved periodically extends the reservation of the hash, until the returned function is called.
+func (s *Handler) keepReserved(ctx context.Context, hash []byte, owner string) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(reservationTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = s.Repo.Reserve(ctx, hash, owner, reservationTTL)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// copyFile moves the temp file to its place in the archive, updating the path and the creation date of the media
+// accordingly: the latter is extracted from the file itself whenever possible.
+func (s *Handler) copyFile(m *db.Media, tmpPath string) error {
 	start := time.Now()
 	defer func() {
 		metrics.CopyFileDurationMs.Observe(float64(time.Since(start).Milliseconds()))
 	}()
 
-	filename := filepath.Base(m.Path)
-	tmpPath, err := s.writeFile(filename, bufio.NewReader(&buffer))
+	l := s.Layout
+	if l == nil {
+		l = layout.Default
+	}
+
+	attrs, err := l.ReadAttributes(tmpPath, m.Path, m.Hash, m.CreatedAt)
 	if err != nil {
-		return "", fmt.Errorf("unable to write temp file: %w", err)
+		return err
+	}
+	createdAt := attrs.CreatedAt
+
+	dir, filename := l.Resolve(attrs)
+	dir = filepath.Join(s.ArchivePath, dir)
+
+	// whatever the layout makes of the attributes sent by the client, files must never land outside of the archive
+	if !withinDir(s.ArchivePath, dir) || filename != filepath.Base(filename) || filename == ".." {
+		return fmt.Errorf("invalid archive path: %v", filepath.Join(dir, filename))
 	}
 
-	createdAt, err := image.ParseCreatedAt(tmpPath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create archive subdirectory %v: %w", dir, err)
+	}
+
+	candidates := candidatePaths(dir, filename, m.Hash)
+
+	// record the pending import before moving the file, so that the archive and the repository can be reconciled if
+	// the server stops before the media is stored
+	pending := *m
+	pending.CreatedAt = createdAt
+	if err := s.writeJournal(journalEntry{Media: pending, TmpPath: tmpPath, Candidates: candidates}); err != nil {
+		return err
+	}
+
+	newPath, err := moveFile(tmpPath, candidates)
 	if err != nil {
-		if !errors.Is(err, &image.ErrNotFound{}) {
-			return "", fmt.Errorf("unable to parse createdAt: %w", err)
+		// a file left in the archive is only reconciled with the repository through its journal entry
+		if !errors.Is(err, errLeftInArchive) {
+			_ = s.clearJournal(m.Hash)
 		}
+		return err
+	}
+
+	m.Path = newPath
+	m.CreatedAt = createdAt
 
-		createdAt = m.CreatedAt
+	return nil
+}
+
+// candidatePaths returns the paths, in order of preference, that a file may be moved to without overwriting an existing
+// one: if another file with the same name already exists, the name is suffixed with an increasingly long prefix of the
+// (hex-encoded) hash of the content and, as a last resort, with a counter as well. Names are shortened as needed to fit
+// in maxNameLength, suffixes included.
+func candidatePaths(dir, filename string, hash []byte) []string {
+	ext := filepath.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+	hexHash := hex.EncodeToString(hash)
+
+	paths := []string{filepath.Join(dir, fitName(stem, "", ext))}
+	for _, n := range []int{8, 16, 32} {
+		paths = append(paths, filepath.Join(dir, fitName(stem, "_"+hexHash[:min(n, len(hexHash))], ext)))
 	}
 
-	year := createdAt.Format("2006")
-	month := createdAt.Format("01")
-	day := createdAt.Format("02")
-	ymdDir := filepath.Join(s.ArchivePath, year, month, day)
+	for i := 1; i <= maxCollisionCounter; i++ {
+		paths = append(paths, filepath.Join(dir, fitName(stem, fmt.Sprintf("_%s_%d", hexHash[:min(32, len(hexHash))], i), ext)))
+	}
+
+	return paths
+}
 
-	if err := os.MkdirAll(ymdDir, os.ModePerm); err != nil {
-		return "", fmt.Errorf("unable to create archive subdirectory %v: %w", ymdDir, err)
+// withinDir reports whether path is dir or lies under it, once both are cleaned.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// fitName joins stem, suffix and ext, truncating stem (without splitting its characters) so that the result fits in
+// maxNameLength bytes.
+func fitName(stem, suffix, ext string) string {
+	limit := max(maxNameLength-len(suffix)-len(ext), 0)
+	for len(stem) > limit {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
 	}
 
-	newPath := filepath.Join(ymdDir, filename)
-	if err := os.Rename(tmpPath, newPath); err != nil {
-		return "", fmt.Errorf("cannot replace %s with temp file %s: %v", tmpPath, newPath, err)
+	return stem + suffix + ext
+}
+
+// errLeftInArchive is returned by moveFile when it fails after linking the temp file into the archive, and cannot undo
+// that.
+var errLeftInArchive = errors.New("file left in the archive")
+
+// moveFile moves the temp file to the first of the candidate paths that is not taken, without ever overwriting an
+// existing file.
+func moveFile(tmpPath string, candidates []string) (string, error) {
+	for _, newPath := range candidates {
+		// unlike os.Rename, os.Link fails if the target already exists
+		err := os.Link(tmpPath, newPath)
+		if err == nil {
+			if err := syncDir(filepath.Dir(newPath)); err != nil {
+				// undo the link, otherwise the archive would hold a file unknown to the repository
+				if rmErr := os.Remove(newPath); rmErr != nil && !os.IsNotExist(rmErr) {
+					return "", fmt.Errorf("%w: %v: %v", errLeftInArchive, newPath, errors.Join(err, rmErr))
+				}
+				return "", err
+			}
+
+			_ = os.Remove(tmpPath)
+			return newPath, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("cannot move temp file %s to %s: %v", tmpPath, newPath, err)
+		}
 	}
 
-	return newPath, nil
+	return "", fmt.Errorf("cannot move temp file %s: all candidate names are taken", tmpPath)
 }
 
-func (s *Handler) writeFile(filename string, r io.Reader) (string, error) {
+// writeFile writes the chunks received from the stream to a temporary file in the staging directory as they arrive,
+// failing as soon as their total size exceeds the expected one. It returns the path of the temporary file and the hash
+// of its content, computed while writing it. The temporary file is removed in case of errors, including cancelled
+// streams.
+func (s *Handler) writeFile(filename string, expectedSize int64, req *connect.ClientStream[arkv1.UploadFileRequest]) (_ string, _ []byte, err error) {
 	tmpDir := filepath.Join(s.ArchivePath, "tmp")
 	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
-		return "", fmt.Errorf("unable to create temporary subdirectory %v: %w", tmpDir, err)
+		return "", nil, fmt.Errorf("unable to create temporary subdirectory %v: %w", tmpDir, err)
 	}
 
 	ext := filepath.Ext(filename)
 	f, err := os.CreateTemp(tmpDir, fmt.Sprintf("%s.*%s", filename, ext))
 	if err != nil {
-		return "", fmt.Errorf("cannot create temp file: %v", err)
+		return "", nil, fmt.Errorf("cannot create temp file: %v", err)
 	}
+	name := f.Name()
+	s.inFlight.add(name)
 	defer func() {
 		if err != nil {
-			_ = os.Remove(f.Name())
+			_ = f.Close()
+			_ = os.Remove(name)
+			s.inFlight.remove(name)
 		}
 	}()
-	defer f.Close()
-	name := f.Name()
-	if _, err := io.Copy(f, r); err != nil {
-		return "", fmt.Errorf("cannot write data to temp file %q: %v", name, err)
+
+	h := fs.NewHash()
+	if _, err := receiveChunks(io.MultiWriter(f, h), 0, expectedSize, req); err != nil {
+		return "", nil, err
 	}
-	// fsync is important, otherwise os.Rename could rename a zero-length file
+
+	// fsync is important, otherwise a zero-length file could end up in the archive
 	if err := f.Sync(); err != nil {
-		return "", fmt.Errorf("cannot flush temp file %q: %v", name, err)
+		return "", nil, fmt.Errorf("cannot flush temp file %q: %v", name, err)
 	}
 	if err := f.Close(); err != nil {
-		return "", fmt.Errorf("cannot close temp file %q: %v", name, err)
+		return "", nil, fmt.Errorf("cannot close temp file %q: %v", name, err)
+	}
+
+	return name, h.Sum(nil), nil
+}
+
+// receiveChunks writes the chunks received from the stream to w, failing as soon as their total size, added to the
+// offset, exceeds the expected one. It returns the total size written, including the offset.
+func receiveChunks(w io.Writer, offset, expectedSize int64, req *connect.ClientStream[arkv1.UploadFileRequest]) (int64, error) {
+	size := offset
+	for req.Receive() {
+		n, err := w.Write(req.Msg().GetChunk().GetData())
+		size += int64(n)
+		if err != nil {
+			return size, fmt.Errorf("cannot write data: %v", err)
+		}
+
+		if size > expectedSize {
+			return size, fmt.Errorf("total size mismatch: expected %v, got at least %v", expectedSize, size)
+		}
+	}
+
+	if err := req.Err(); err != nil {
+		return size, err
+	}
+
+	if size != expectedSize {
+		return size, fmt.Errorf("total size mismatch: expected %v, got %v", expectedSize, size)
+	}
+
+	return size, nil
+}
+
+// asConnectError returns err as is if it is a connect error, otherwise wraps it in a new one with the given code.
+func asConnectError(code connect.Code, err error) error {
+	var cerr *connect.Error
+	if errors.As(err, &cerr) {
+		return cerr
 	}
 
-	return name, nil
+	return connect.NewError(code, err)
 }
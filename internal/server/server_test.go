@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCandidatePaths(t *testing.T) {
+	// as big as the hashes computed by fs.Hash
+	hash := make([]byte, 256)
+	if _, err := rand.Read(hash); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filename  string
+		preferred string
+	}{
+		{name: "short name", filename: "IMG_0001.JPG", preferred: "IMG_0001.JPG"},
+		{name: "long name", filename: strings.Repeat("a", 300) + ".JPG", preferred: strings.Repeat("a", 251) + ".JPG"},
+		{name: "long multibyte name", filename: strings.Repeat("é", 150) + ".JPG", preferred: strings.Repeat("é", 125) + ".JPG"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := candidatePaths("2019/03/14", tt.filename, hash)
+			if candidates[0] != filepath.Join("2019/03/14", tt.preferred) {
+				t.Errorf("expected the original name to be preferred, got %v", candidates[0])
+			}
+
+			seen := make(map[string]bool)
+			for _, c := range candidates {
+				if name := filepath.Base(c); len(name) > 255 || !utf8.ValidString(name) {
+					t.Errorf("invalid name (%v bytes): %v", len(name), name)
+				}
+
+				if seen[c] {
+					t.Errorf("duplicate candidate: %v", c)
+				}
+				seen[c] = true
+
+				if filepath.Ext(c) != ".JPG" {
+					t.Errorf("expected the extension to be kept, got %v", c)
+				}
+			}
+		})
+	}
+}
+
+func TestUploads_WaitRespectsContext(t *testing.T) {
+	var u uploads
+	if !u.begin() {
+		t.Fatal("expected the upload to begin")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := u.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+
+	if u.begin() {
+		t.Error("expected new uploads to be rejected while draining")
+	}
+
+	u.end()
+	if err := u.wait(context.Background()); err != nil {
+		t.Errorf("wait() error = %v", err)
+	}
+}
+
+func TestWithinDir(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/archive", want: true},
+		{path: "/archive/2019/03", want: true},
+		{path: "/archive/..archive", want: true},
+		{path: "/archive/2019/../..", want: false},
+		{path: "/archive/../etc", want: false},
+		{path: "/elsewhere", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := withinDir("/archive", tt.path); got != tt.want {
+			t.Errorf("withinDir(%v) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
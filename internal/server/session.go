@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	arkv1 "github.com/fedragon/ark/gen/ark/v1"
+	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/metrics"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const defaultUploadSessionTTL = 24 * time.Hour
+
+// OpenUploadSession opens a resumable upload session for the given file, or returns the existing one if the server
+// already holds part of its content: the client is expected to continue its upload from the returned offset.
+func (s *Handler) OpenUploadSession(ctx context.Context, req *connect.Request[arkv1.OpenUploadSessionRequest]) (*connect.Response[arkv1.OpenUploadSessionResponse], error) {
+	metadata := req.Msg.GetMetadata()
+	if metadata == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("expected metadata"))
+	}
+
+	media, err := s.Repo.Get(ctx, metadata.GetHash())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if media != nil {
+		metrics.TotalDuplicates.Inc()
+		return nil, connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("file already exists: %v", media.Path))
+	}
+
+	session, err := s.Repo.GetUploadSession(ctx, metadata.GetHash())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var offset int64
+	if session != nil && session.Size == metadata.GetSize() {
+		stat, err := os.Stat(s.sessionPath(*session))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		if err == nil {
+			offset = stat.Size()
+
+			// keep the partial file from being swept as long as the session is alive
+			now := time.Now()
+			if err := os.Chtimes(s.sessionPath(*session), now, now); err != nil {
+				return nil, connect.NewError(connect.CodeInternal, err)
+			}
+		}
+	} else {
+		if session != nil {
+			// the client is uploading something different from what it declared the last time: start over
+			_ = os.Remove(s.sessionPath(*session))
+		}
+
+		id, err := newID()
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		session = &db.UploadSession{
+			ID:   id,
+			Hash: metadata.GetHash(),
+			Name: filepath.Base(metadata.GetName()),
+			Size: metadata.GetSize(),
+		}
+	}
+
+	ttl := s.uploadSessionTTL()
+	if err := s.Repo.StoreUploadSession(ctx, *session, ttl); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&arkv1.OpenUploadSessionResponse{
+		SessionId: session.ID,
+		Offset:    offset,
+		ExpiresAt: timestamppb.New(time.Now().Add(ttl)),
+	}), nil
+}
+
+// resumeFile appends the chunks received from the stream to the partial file of the upload session, which must
+// contain exactly as many bytes as the offset declared in the metadata. It returns the path of the partial file and the
+// hash of its whole content. If the stream ends before the expected size is reached, the partial file is kept so that
+// the upload can be resumed later on; in case of any other error, both the partial file and the session are discarded.
+func (s *Handler) resumeFile(ctx context.Context, m *arkv1.Metadata, req *connect.ClientStream[arkv1.UploadFileRequest]) (_ string, _ []byte, err error) {
+	session, err := s.Repo.GetUploadSession(ctx, m.GetHash())
+	if err != nil {
+		return "", nil, err
+	}
+
+	if session == nil || session.ID != m.GetSessionId() {
+		return "", nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("unknown or expired upload session: %v", m.GetSessionId()))
+	}
+
+	if session.Size != m.GetSize() {
+		return "", nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("total size mismatch: expected %v, got %v", session.Size, m.GetSize()))
+	}
+
+	path := s.sessionPath(*session)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", nil, fmt.Errorf("unable to create sessions subdirectory %v: %w", filepath.Dir(path), err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot open partial file %q: %v", path, err)
+	}
+
+	s.inFlight.add(path)
+
+	interrupted := false
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		s.inFlight.remove(path)
+
+		if interrupted {
+			_ = f.Sync()
+			_ = f.Close()
+			now := time.Now()
+			_ = os.Chtimes(path, now, now)
+			// give the client some more time to resume the upload
+			_ = s.Repo.StoreUploadSession(context.WithoutCancel(ctx), *session, s.uploadSessionTTL())
+			return
+		}
+
+		_ = f.Close()
+		_ = os.Remove(path)
+		_ = s.Repo.DeleteUploadSession(context.WithoutCancel(ctx), m.GetHash())
+	}()
+
+	// re-hash what has already been received, leaving the file offset at its end
+	h := fs.NewHash()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read partial file %q: %v", path, err)
+	}
+
+	if offset != m.GetOffset() {
+		interrupted = true
+		return "", nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("offset mismatch: expected %v, got %v", offset, m.GetOffset()))
+	}
+
+	size, err := receiveChunks(io.MultiWriter(f, h), offset, m.GetSize(), req)
+	if err != nil {
+		// a dropped connection does not necessarily surface as a stream error: anything short of the expected size
+		// can be resumed
+		interrupted = size < m.GetSize()
+		return "", nil, err
+	}
+
+	// fsync is important, otherwise a zero-length file could end up in the archive
+	if err := f.Sync(); err != nil {
+		return "", nil, fmt.Errorf("cannot flush partial file %q: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, fmt.Errorf("cannot close partial file %q: %v", path, err)
+	}
+
+	return path, h.Sum(nil), nil
+}
+
+func (s *Handler) sessionPath(session db.UploadSession) string {
+	return filepath.Join(s.ArchivePath, "tmp", "sessions", session.ID+filepath.Ext(session.Name))
+}
+
+func (s *Handler) uploadSessionTTL() time.Duration {
+	if s.UploadSessionTTL > 0 {
+		return s.UploadSessionTTL
+	}
+
+	return defaultUploadSessionTTL
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fedragon/ark/internal/metrics"
+)
+
+// inFlight tracks the staged files of the uploads that are in progress, which must never be swept.
+type inFlight struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+func (f *inFlight) add(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.paths == nil {
+		f.paths = make(map[string]struct{})
+	}
+	f.paths[path] = struct{}{}
+}
+
+func (f *inFlight) remove(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.paths, path)
+}
+
+func (f *inFlight) has(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.paths[path]
+	return ok
+}
+
+// SweepStagingArea deletes the staged files that have not been modified for longer than maxAge and are not tied to an
+// upload in progress, e.g. the leftovers of uploads that failed before the server could clean up after them. The
+// partial files of upload sessions are only deleted once their session has expired too. It returns how many bytes
+// have been reclaimed.
+func (s *Handler) SweepStagingArea(maxAge time.Duration) (int64, error) {
+	tmpDir := filepath.Join(s.ArchivePath, "tmp")
+	sessionsDir := filepath.Join(tmpDir, "sessions")
+
+	reclaimed, err := s.sweep(tmpDir, time.Now().Add(-maxAge))
+	if err != nil {
+		return reclaimed, err
+	}
+
+	// sessions are refreshed every time they are (re)opened or interrupted, which also touches their partial file
+	n, err := s.sweep(sessionsDir, time.Now().Add(-max(maxAge, s.uploadSessionTTL())))
+	reclaimed += n
+
+	metrics.StagingReclaimedBytes.Add(float64(reclaimed))
+
+	return reclaimed, err
+}
+
+// sweep deletes the files in dir (not in its subdirectories) that have not been modified since before cutoff.
+func (s *Handler) sweep(dir string, cutoff time.Time) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to read staging directory %v: %w", dir, err)
+	}
+
+	var reclaimed int64
+	var errs []error
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		if s.inFlight.has(path) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		reclaimed += info.Size()
+	}
+
+	return reclaimed, errors.Join(errs...)
+}
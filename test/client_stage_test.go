@@ -5,15 +5,19 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	arkv1 "github.com/fedragon/ark/gen/ark/v1"
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/fs"
 	"github.com/fedragon/ark/internal/importer"
 	_ "github.com/fedragon/ark/testing"
 
 	"connectrpc.com/connect"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -22,14 +26,55 @@ type MockArkApiServer struct {
 
 	arkv1connect.UnimplementedArkApiHandler
 
-	uploadFileResponse *arkv1.UploadFileResponse
-	uploadFileError    error
+	findDuplicatesResponse *arkv1.FindDuplicatesResponse
+	findDuplicatesError    error
+	uploadFileResponse     *arkv1.UploadFileResponse
+	uploadFileError        error
+	uploadFileCalls        atomic.Int32
+	// unavailableUploads is how many of the next uploads fail with a transient error
+	unavailableUploads atomic.Int32
+	// failingUpload is the name (i.e. path) of the file whose upload fails, if any
+	failingUpload string
+	// hangingUploads makes the uploads of the other files hang until cancelled
+	hangingUploads bool
 }
 
-func (maas *MockArkApiServer) UploadFile(_ context.Context, _ *connect.ClientStream[arkv1.UploadFileRequest]) (*connect.Response[arkv1.UploadFileResponse], error) {
+func (maas *MockArkApiServer) FindDuplicates(_ context.Context, _ *connect.Request[arkv1.FindDuplicatesRequest]) (*connect.Response[arkv1.FindDuplicatesResponse], error) {
+	if maas.findDuplicatesError != nil {
+		return nil, maas.findDuplicatesError
+	}
+
+	if maas.findDuplicatesResponse == nil {
+		return connect.NewResponse(&arkv1.FindDuplicatesResponse{}), nil
+	}
+
+	return connect.NewResponse(maas.findDuplicatesResponse), nil
+}
+
+func (maas *MockArkApiServer) UploadFile(ctx context.Context, req *connect.ClientStream[arkv1.UploadFileRequest]) (*connect.Response[arkv1.UploadFileResponse], error) {
+	maas.uploadFileCalls.Add(1)
+
+	if maas.unavailableUploads.Add(-1) >= 0 {
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("server is restarting"))
+	}
+
+	if maas.failingUpload != "" && req.Receive() {
+		switch {
+		case req.Msg().GetMetadata().GetName() == maas.failingUpload:
+			return nil, connect.NewError(connect.CodeInternal, errors.New("something went wrong"))
+		case maas.hangingUploads:
+			<-ctx.Done()
+			return nil, connect.NewError(connect.CodeCanceled, ctx.Err())
+		}
+	}
+
 	return connect.NewResponse(maas.uploadFileResponse), maas.uploadFileError
 }
 
+func (maas *MockArkApiServer) setFindDuplicatesResponse(response *arkv1.FindDuplicatesResponse) {
+	maas.findDuplicatesResponse = response
+}
+
 func (maas *MockArkApiServer) setUploadFileResponse(response *arkv1.UploadFileResponse) {
 	maas.uploadFileResponse = response
 }
@@ -39,11 +84,16 @@ func (maas *MockArkApiServer) setUploadFileError(err error) {
 }
 
 type ClientStage struct {
-	t           *testing.T
-	imp         importer.Importer
-	mock        *MockArkApiServer
-	server      *httptest.Server
-	importError error
+	t             *testing.T
+	client        arkv1connect.ArkApiClient
+	types         []string
+	imp           importer.Importer
+	mock          *MockArkApiServer
+	server        *httptest.Server
+	importError   error
+	importSummary *importer.Summary
+	importTime    time.Duration
+	plan          *importer.Plan
 }
 
 func NewClientStage(t *testing.T) *ClientStage {
@@ -57,17 +107,17 @@ func NewClientStage(t *testing.T) *ClientStage {
 	server.EnableHTTP2 = true
 	server.Start()
 
+	client := arkv1connect.NewArkApiClient(
+		http.DefaultClient,
+		server.URL,
+		connect.WithSendGzip(),
+	)
+
 	return &ClientStage{
-		t: t,
-		imp: importer.NewImporter(
-			arkv1connect.NewArkApiClient(
-				http.DefaultClient,
-				server.URL,
-				connect.WithSendGzip(),
-			),
-			types,
-			zap.NewNop(),
-		),
+		t:      t,
+		client: client,
+		types:  types,
+		imp:    importer.NewImporter(client, types, zap.NewNop()),
 		mock:   mock,
 		server: server,
 	}
@@ -99,13 +149,163 @@ func (s *ClientStage) UploadFileWillBeSkipped() *ClientStage {
 	return s
 }
 
+func (s *ClientStage) FileIsAlreadyKnown(path string) *ClientStage {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	s.mock.setFindDuplicatesResponse(&arkv1.FindDuplicatesResponse{
+		Duplicates: []*arkv1.Duplicate{{Hash: hash, Path: "2023/01/01/doge.jpg"}},
+	})
+	return s
+}
+
 func (s *ClientStage) UploadFileWillFail() *ClientStage {
 	s.mock.setUploadFileError(connect.NewError(connect.CodeInternal, errors.New("something went wrong")))
 	return s
 }
 
+func (s *ClientStage) UploadOfFileWillFail(name string) *ClientStage {
+	s.mock.setUploadFileResponse(&arkv1.UploadFileResponse{})
+	s.mock.failingUpload = name
+	return s
+}
+
+func (s *ClientStage) UploadFileWillBeUnavailable(times int) *ClientStage {
+	s.mock.setUploadFileResponse(&arkv1.UploadFileResponse{})
+	s.mock.unavailableUploads.Store(int32(times))
+	return s
+}
+
+func (s *ClientStage) UploadFileWillBeRejected() *ClientStage {
+	s.mock.setUploadFileError(connect.NewError(connect.CodeInvalidArgument, errors.New("invalid metadata")))
+	return s
+}
+
+func (s *ClientStage) ClientRetriesUploads(times int) *ClientStage {
+	s.imp = importer.NewImporter(s.client, s.types, zap.NewNop(), importer.WithRetryPolicy(importer.RetryPolicy{
+		MaxRetries:     times,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}))
+	return s
+}
+
+func (s *ClientStage) FindDuplicatesWillFail() *ClientStage {
+	s.mock.findDuplicatesError = connect.NewError(connect.CodeInternal, errors.New("something went wrong"))
+	return s
+}
+
+func (s *ClientStage) UploadsOfOtherFilesWillHang() *ClientStage {
+	s.mock.hangingUploads = true
+	return s
+}
+
+func (s *ClientStage) ClientUploadsFilesAtOnce(n int) *ClientStage {
+	s.imp = importer.NewImporter(s.client, s.types, zap.NewNop(), importer.WithSenders(n))
+	return s
+}
+
+func (s *ClientStage) ClientContinuesOnError() *ClientStage {
+	s.imp = importer.NewImporter(s.client, s.types, zap.NewNop(), importer.WithContinueOnError())
+	return s
+}
+
+func (s *ClientStage) ClientImports(path string) *ClientStage {
+	// imports that do not stop by themselves fail with DeadlineExceeded
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	s.importSummary, s.importError = s.imp.Import(ctx, path)
+	s.importTime = time.Since(start)
+
+	return s
+}
+
+func (s *ClientStage) ImportStopsPromptly() *ClientStage {
+	require.Less(s.t, s.importTime, 5*time.Second)
+	return s
+}
+
+func (s *ClientStage) ImportFailsWith(code connect.Code) *ClientStage {
+	require.Error(s.t, s.importError)
+	require.Equal(s.t, code, connect.CodeOf(s.importError), s.importError.Error())
+
+	return s
+}
+
+func (s *ClientStage) ImportReports(imported, duplicates int) *ClientStage {
+	require.NoError(s.t, s.importError)
+	require.Equal(s.t, imported, s.importSummary.Imported)
+	require.Equal(s.t, duplicates, s.importSummary.Duplicates)
+
+	return s
+}
+
+func (s *ClientStage) FileFailedAt(path, stage string) *ClientStage {
+	require.Len(s.t, s.importSummary.Failures, 1)
+	require.Equal(s.t, path, s.importSummary.Failures[0].Path)
+	require.Equal(s.t, stage, s.importSummary.Failures[0].Stage)
+
+	return s
+}
+
 func (s *ClientStage) ClientUploadsFile() *ClientStage {
-	s.importError = s.imp.Import(context.Background(), "./test/testdata/doge.jpg")
+	s.importSummary, s.importError = s.imp.Import(context.Background(), "./test/testdata/doge.jpg")
+	return s
+}
+
+func (s *ClientStage) ClientPlansImport(path string) *ClientStage {
+	plan, err := s.imp.Plan(context.Background(), path)
+	require.NoError(s.t, err)
+	s.plan = plan
+
+	return s
+}
+
+func (s *ClientStage) PlanReports(toImport, duplicates int, bytesToTransfer int64) *ClientStage {
+	require.Equal(s.t, toImport, s.plan.ToImport)
+	require.Equal(s.t, duplicates, s.plan.Duplicates)
+	require.Equal(s.t, bytesToTransfer, s.plan.BytesToTransfer)
+
+	return s
+}
+
+func (s *ClientStage) PlanReportsFailures(count int, stage string) *ClientStage {
+	require.Empty(s.t, s.plan.Files)
+	require.Len(s.t, s.plan.Failures, count)
+	for _, f := range s.plan.Failures {
+		require.Equal(s.t, stage, f.Stage)
+	}
+
+	return s
+}
+
+func (s *ClientStage) plannedFile(path string) importer.PlannedFile {
+	for _, f := range s.plan.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+
+	s.t.Fatalf("%v not found in plan", path)
+	return importer.PlannedFile{}
+}
+
+func (s *ClientStage) FileIsPlannedAs(path, action, archivePath string) *ClientStage {
+	f := s.plannedFile(path)
+	require.Equal(s.t, action, f.Action)
+	require.Equal(s.t, archivePath, f.ArchivePath)
+
+	return s
+}
+
+func (s *ClientStage) FileIsPlannedAsDuplicateOf(path, original string) *ClientStage {
+	f := s.plannedFile(path)
+	require.Equal(s.t, importer.ActionDuplicate, f.Action)
+	require.Equal(s.t, importer.ActionImport, s.plannedFile(original).Action)
+	require.Equal(s.t, s.plannedFile(original).ArchivePath, f.ArchivePath)
+
 	return s
 }
 
@@ -113,3 +313,19 @@ func (s *ClientStage) ImportSucceeds() *ClientStage {
 	assert.NoError(s.t, s.importError)
 	return s
 }
+
+func (s *ClientStage) ImportFails() *ClientStage {
+	assert.Error(s.t, s.importError)
+	return s
+}
+
+func (s *ClientStage) UploadIsAttempted(times, retries int) *ClientStage {
+	assert.Equal(s.t, int32(times), s.mock.uploadFileCalls.Load())
+	assert.Equal(s.t, retries, s.importSummary.Retries)
+	return s
+}
+
+func (s *ClientStage) FileIsNotUploaded() *ClientStage {
+	assert.Zero(s.t, s.mock.uploadFileCalls.Load())
+	return s
+}
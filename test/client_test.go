@@ -1,6 +1,12 @@
 package test
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/fedragon/ark/internal/importer"
+
+	"connectrpc.com/connect"
+)
 
 type ClientTest struct {
 	Stage *ClientStage
@@ -21,3 +27,109 @@ func Test_Client_UploadFile_Succeeds(t *testing.T) {
 	s.Then().
 		ImportSucceeds()
 }
+
+func Test_Client_UploadFile_SkipsKnownDuplicates(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		FileIsAlreadyKnown("./test/testdata/doge.jpg")
+
+	s.When().
+		ClientUploadsFile()
+
+	s.Then().
+		ImportSucceeds().And().
+		FileIsNotUploaded()
+}
+
+func Test_Client_PlanImport_ReportsWhatWouldBeImported(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		FileIsAlreadyKnown("./test/testdata/grumpy-cat.jpg")
+
+	s.When().
+		ClientPlansImport("./test/testdata")
+
+	s.Then().
+		PlanReports(2, 2, 678707+160431).And().
+		FileIsPlannedAs("test/testdata/grumpy-cat.jpg", importer.ActionDuplicate, "2023/01/01/doge.jpg").And().
+		FileIsPlannedAsDuplicateOf("test/testdata/same-doge.jpg", "test/testdata/doge.jpg").And().
+		FileIsNotUploaded()
+}
+
+func Test_Client_Import_ContinuesOnError(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		FileIsAlreadyKnown("./test/testdata/doge.jpg").And().
+		UploadOfFileWillFail("test/testdata/grumpy-cat.jpg").And().
+		ClientContinuesOnError()
+
+	s.When().
+		ClientImports("./test/testdata")
+
+	s.Then().
+		ImportReports(1, 2).And().
+		FileFailedAt("test/testdata/grumpy-cat.jpg", importer.StageUpload)
+}
+
+func Test_Client_UploadFile_RetriesTransientErrors(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		UploadFileWillBeUnavailable(2).And().
+		ClientRetriesUploads(3)
+
+	s.When().
+		ClientUploadsFile()
+
+	s.Then().
+		ImportSucceeds().And().
+		UploadIsAttempted(3, 2)
+}
+
+func Test_Client_UploadFile_DoesNotRetryPermanentErrors(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		UploadFileWillBeRejected().And().
+		ClientRetriesUploads(3)
+
+	s.When().
+		ClientUploadsFile()
+
+	s.Then().
+		ImportFails().And().
+		UploadIsAttempted(1, 0)
+}
+
+func Test_Client_Import_StopsAtFirstError(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		UploadOfFileWillFail("test/testdata/grumpy-cat.jpg").And().
+		UploadsOfOtherFilesWillHang().And().
+		ClientUploadsFilesAtOnce(4)
+
+	s.When().
+		ClientImports("./test/testdata")
+
+	s.Then().
+		ImportFailsWith(connect.CodeInternal).And().
+		ImportStopsPromptly()
+}
+
+func Test_Client_PlanImport_ContinuesOnError(t *testing.T) {
+	s := NewClientTest(t).Stage
+
+	s.Given().
+		FindDuplicatesWillFail().And().
+		ClientContinuesOnError()
+
+	s.When().
+		ClientPlansImport("./test/testdata")
+
+	s.Then().
+		PlanReportsFailures(4, importer.StageCheck)
+}
@@ -2,16 +2,25 @@ package test
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	arkv1 "github.com/fedragon/ark/gen/ark/v1"
 	"github.com/fedragon/ark/gen/ark/v1/arkv1connect"
+	"github.com/fedragon/ark/internal/auth"
 	"github.com/fedragon/ark/internal/db"
+	"github.com/fedragon/ark/internal/downloader"
 	"github.com/fedragon/ark/internal/fs"
+	"github.com/fedragon/ark/internal/indexer"
+	"github.com/fedragon/ark/internal/scrubber"
 	"github.com/fedragon/ark/internal/server"
 	_ "github.com/fedragon/ark/testing"
 
@@ -19,14 +28,36 @@ import (
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ServerStage struct {
 	t           *testing.T
 	server      *httptest.Server
+	handler     *server.Handler
+	archivePath string
 	client      arkv1connect.ArkApiClient
 	uploadError error
+	duplicates  []*arkv1.Duplicate
+
+	downloadDir   string
+	downloadError error
+
+	listed []*arkv1.Media
+
+	reindexReport *indexer.Report
+	scrubbed      *arkv1.ScrubArchiveResponse
+	reclaimed     int64
+
+	keysDir         string
+	enrollmentCode  string
+	enrollment      *arkv1.EnrollResponse
+	enrollmentError error
+
+	pendingStream *connect.ClientStreamForClient[arkv1.UploadFileRequest, arkv1.UploadFileResponse]
+	pendingData   []byte
+	pendingError  error
 }
 
 func NewServerStage(t *testing.T) *ServerStage {
@@ -38,9 +69,16 @@ func NewServerStage(t *testing.T) *ServerStage {
 	// Remove all keys from Redis
 	client.FlushDB(context.Background())
 
+	archivePath := t.TempDir()
+	keysDir := t.TempDir()
+	keys, err := auth.NewKeySet(nil, keysDir)
+	require.NoError(t, err)
+
 	handler := &server.Handler{
 		Repo:        repo,
-		ArchivePath: "./archive",
+		ArchivePath: archivePath,
+		Scrubber:    scrubber.NewScrubber(repo, zap.NewNop()),
+		Keys:        keys,
 	}
 
 	mux := http.NewServeMux()
@@ -51,9 +89,12 @@ func NewServerStage(t *testing.T) *ServerStage {
 	us.Start()
 
 	return &ServerStage{
-		t:      t,
-		server: us,
-		client: arkv1connect.NewArkApiClient(http.DefaultClient, us.URL),
+		t:           t,
+		server:      us,
+		handler:     handler,
+		archivePath: archivePath,
+		keysDir:     keysDir,
+		client:      arkv1connect.NewArkApiClient(http.DefaultClient, us.URL),
 	}
 }
 
@@ -115,6 +156,39 @@ func (s *ServerStage) ClientUploadsFile(path string) *ServerStage {
 	return s
 }
 
+func (s *ServerStage) ClientUploadsFileAs(path, name string, createdAt time.Time) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	stream := s.client.UploadFile(context.Background())
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: &arkv1.Metadata{
+				Hash:      hash,
+				Name:      name,
+				Size:      int64(len(data)),
+				CreatedAt: timestamppb.New(createdAt),
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data,
+			},
+		},
+	})
+	require.NoError(s.t, err)
+	_, s.uploadError = stream.CloseAndReceive()
+
+	return s
+}
+
 func (s *ServerStage) ClientUploadsFileAgain(path string) *ServerStage {
 	data, err := os.ReadFile(path)
 	require.NoError(s.t, err)
@@ -139,6 +213,621 @@ func (s *ServerStage) ClientUploadsFileAgain(path string) *ServerStage {
 	return s
 }
 
+func (s *ServerStage) ClientUploadsTruncatedFile(path string) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	stream := s.client.UploadFile(context.Background())
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: &arkv1.Metadata{
+				Hash:      hash,
+				Name:      path,
+				Size:      int64(len(data)),
+				CreatedAt: timestamppb.New(time.Now()),
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data[:len(data)/2],
+			},
+		},
+	})
+	require.NoError(s.t, err)
+	_, s.uploadError = stream.CloseAndReceive()
+
+	return s
+}
+
+func (s *ServerStage) ClientUploadsFileWithWrongHash(path string) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	stream := s.client.UploadFile(context.Background())
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: &arkv1.Metadata{
+				Hash:      []byte("not-the-right-hash"),
+				Name:      path,
+				Size:      int64(len(data)),
+				CreatedAt: timestamppb.New(time.Now()),
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data,
+			},
+		},
+	})
+	require.NoError(s.t, err)
+	_, s.uploadError = stream.CloseAndReceive()
+
+	return s
+}
+
+func (s *ServerStage) ClientUploadIsInterruptedHalfway(path string) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	metadata := &arkv1.Metadata{
+		Hash:      hash,
+		Name:      path,
+		Size:      int64(len(data)),
+		CreatedAt: timestamppb.New(time.Now()),
+	}
+
+	res, err := s.client.OpenUploadSession(context.Background(), connect.NewRequest(&arkv1.OpenUploadSessionRequest{Metadata: metadata}))
+	require.NoError(s.t, err)
+	require.Zero(s.t, res.Msg.GetOffset())
+
+	metadata.SessionId = res.Msg.GetSessionId()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := s.client.UploadFile(ctx)
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: metadata,
+		},
+	})
+	require.NoError(s.t, err)
+
+	half := int64(len(data) / 2)
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data[:half],
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	// wait for the server to receive the chunk before dropping the connection
+	partialPath := filepath.Join(s.archivePath, "tmp", "sessions", metadata.SessionId+filepath.Ext(path))
+	require.Eventually(s.t, func() bool {
+		stat, err := os.Stat(partialPath)
+		return err == nil && stat.Size() == half
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	_, _ = stream.CloseAndReceive()
+
+	return s
+}
+
+func (s *ServerStage) ClientResumesUpload(path string) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	metadata := &arkv1.Metadata{
+		Hash:      hash,
+		Name:      path,
+		Size:      int64(len(data)),
+		CreatedAt: timestamppb.New(time.Now()),
+	}
+
+	var res *connect.Response[arkv1.OpenUploadSessionResponse]
+	require.Eventually(s.t, func() bool {
+		res, err = s.client.OpenUploadSession(context.Background(), connect.NewRequest(&arkv1.OpenUploadSessionRequest{Metadata: metadata}))
+		return err == nil && res.Msg.GetOffset() == int64(len(data)/2)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	metadata.SessionId = res.Msg.GetSessionId()
+	metadata.Offset = res.Msg.GetOffset()
+
+	stream := s.client.UploadFile(context.Background())
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: metadata,
+		},
+	})
+	require.NoError(s.t, err)
+
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data[metadata.Offset:],
+			},
+		},
+	})
+	require.NoError(s.t, err)
+	_, s.uploadError = stream.CloseAndReceive()
+
+	return s
+}
+
+func (s *ServerStage) ClientLooksForDuplicates(paths ...string) *ServerStage {
+	hashes := make([][]byte, len(paths))
+	for i, path := range paths {
+		hash, err := fs.Hash(path)
+		require.NoError(s.t, err)
+		hashes[i] = hash
+	}
+
+	res, err := s.client.FindDuplicates(context.Background(), connect.NewRequest(&arkv1.FindDuplicatesRequest{Hashes: hashes}))
+	require.NoError(s.t, err)
+	s.duplicates = res.Msg.GetDuplicates()
+
+	return s
+}
+
+func (s *ServerStage) DuplicatesAreFound(paths ...string) *ServerStage {
+	require.Len(s.t, s.duplicates, len(paths))
+	for i, path := range paths {
+		hash, err := fs.Hash(path)
+		require.NoError(s.t, err)
+		require.Equal(s.t, hash, s.duplicates[i].GetHash())
+		require.NotEmpty(s.t, s.duplicates[i].GetPath())
+	}
+
+	return s
+}
+
+func (s *ServerStage) ClientDownloadsFile(path string) *ServerStage {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	s.downloadDir = s.t.TempDir()
+	s.downloadError = downloader.NewDownloader(s.client, zap.NewNop()).Download(context.Background(), s.downloadDir, [][]byte{hash})
+
+	return s
+}
+
+func (s *ServerStage) DownloadSucceeds(path string) *ServerStage {
+	require.NoError(s.t, s.downloadError)
+
+	expected, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	actual, err := os.ReadFile(filepath.Join(s.downloadDir, filepath.Base(path)))
+	require.NoError(s.t, err)
+	require.Equal(s.t, expected, actual)
+
+	return s
+}
+
+func (s *ServerStage) DownloadFailsWith(code connect.Code) *ServerStage {
+	target := &connect.Error{}
+	if assert.Error(s.t, s.downloadError) && assert.ErrorAs(s.t, s.downloadError, &target) {
+		require.Equal(s.t, code, target.Code(), target.Error())
+	} else {
+		s.t.FailNow()
+	}
+
+	return s
+}
+
+func (s *ServerStage) ClientListsMediaCreatedBetween(from, to time.Time) *ServerStage {
+	req := &arkv1.ListMediaRequest{
+		By:    arkv1.DateField_DATE_FIELD_CREATED_AT,
+		From:  timestamppb.New(from),
+		To:    timestamppb.New(to),
+		Limit: 1,
+	}
+
+	s.listed = nil
+	for {
+		res, err := s.client.ListMedia(context.Background(), connect.NewRequest(req))
+		require.NoError(s.t, err)
+
+		s.listed = append(s.listed, res.Msg.GetMedia()...)
+		if res.Msg.GetNextCursor() == "" {
+			break
+		}
+		req.Cursor = res.Msg.GetNextCursor()
+	}
+
+	return s
+}
+
+func (s *ServerStage) MediaAreListedInOrder(paths ...string) *ServerStage {
+	require.Len(s.t, s.listed, len(paths))
+	for i, path := range paths {
+		hash, err := fs.Hash(path)
+		require.NoError(s.t, err)
+		require.Equal(s.t, hash, s.listed[i].GetHash())
+	}
+
+	return s
+}
+
+func (s *ServerStage) ClientStartsUploadingFile(path string) *ServerStage {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	stream := s.client.UploadFile(context.Background())
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Metadata{
+			Metadata: &arkv1.Metadata{
+				Hash:      hash,
+				Name:      path,
+				Size:      int64(len(data)),
+				CreatedAt: timestamppb.New(time.Now()),
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	half := len(data) / 2
+	err = stream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: data[:half],
+			},
+		},
+	})
+	require.NoError(s.t, err)
+
+	// wait for the server to start writing the file
+	require.Eventually(s.t, func() bool {
+		entries, err := os.ReadDir(filepath.Join(s.archivePath, "tmp"))
+		return err == nil && len(entries) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.pendingStream = stream
+	s.pendingData = data[half:]
+
+	return s
+}
+
+// ServerShutsDown shuts the server down the way the server command does, cancelling the uploads still in progress
+// after timeout.
+func (s *ServerStage) ServerShutsDown(timeout time.Duration) *ServerStage {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.server.Config.Shutdown(ctx); err != nil {
+		require.NoError(s.t, s.server.Config.Close())
+	}
+
+	require.NoError(s.t, s.handler.WaitForUploads(context.Background()))
+
+	return s
+}
+
+func (s *ServerStage) FileIsNotReserved(path string) *ServerStage {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	require.NoError(s.t, s.handler.Repo.Reserve(context.Background(), hash, "someone else", time.Minute))
+
+	return s
+}
+
+func (s *ServerStage) ClientFinishesUploadingFile() *ServerStage {
+	err := s.pendingStream.Send(&arkv1.UploadFileRequest{
+		File: &arkv1.UploadFileRequest_Chunk{
+			Chunk: &arkv1.Chunk{
+				Data: s.pendingData,
+			},
+		},
+	})
+	require.NoError(s.t, err)
+	_, s.pendingError = s.pendingStream.CloseAndReceive()
+
+	return s
+}
+
+func (s *ServerStage) PendingUploadSucceeds() *ServerStage {
+	require.NoError(s.t, s.pendingError)
+	return s
+}
+
+func (s *ServerStage) UploadIsAborted() *ServerStage {
+	target := &connect.Error{}
+	if assert.Error(s.t, s.uploadError) && assert.ErrorAs(s.t, s.uploadError, &target) {
+		require.Equal(s.t, connect.CodeAborted, target.Code(), target.Error())
+	} else {
+		s.t.FailNow()
+	}
+
+	return s
+}
+
+// ServerStopsAfterArchivingFile simulates a server that stopped after moving the file into the archive, but before
+// storing its metadata.
+func (s *ServerStage) ServerStopsAfterArchivingFile(path string) *ServerStage {
+	archived := filepath.Join(s.archivePath, "2024", "01", "01", filepath.Base(path))
+	s.copyTo(path, archived)
+	s.writeJournalEntry(path, filepath.Join(s.archivePath, "tmp", "upload.tmp"), archived)
+
+	return s
+}
+
+// ServerStopsBeforeArchivingFile simulates a server that stopped right before moving the file into the archive.
+func (s *ServerStage) ServerStopsBeforeArchivingFile(path string) *ServerStage {
+	staged := filepath.Join(s.archivePath, "tmp", "upload.tmp")
+	s.copyTo(path, staged)
+	s.writeJournalEntry(path, staged, filepath.Join(s.archivePath, "2024", "01", "01", filepath.Base(path)))
+
+	return s
+}
+
+func (s *ServerStage) copyTo(path, dest string) {
+	data, err := os.ReadFile(path)
+	require.NoError(s.t, err)
+	require.NoError(s.t, os.MkdirAll(filepath.Dir(dest), os.ModePerm))
+	require.NoError(s.t, os.WriteFile(dest, data, 0o644))
+}
+
+func (s *ServerStage) writeJournalEntry(path, tmpPath, candidate string) {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	entry, err := json.Marshal(map[string]any{
+		"media": db.Media{
+			Hash:      hash,
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"tmp_path":   tmpPath,
+		"candidates": []string{candidate},
+	})
+	require.NoError(s.t, err)
+
+	dir := filepath.Join(s.archivePath, "tmp", "journal")
+	require.NoError(s.t, os.MkdirAll(dir, os.ModePerm))
+	require.NoError(s.t, os.WriteFile(filepath.Join(dir, hex.EncodeToString(hash[:32])+".json"), entry, 0o644))
+}
+
+func (s *ServerStage) ServerRestarts() *ServerStage {
+	require.NoError(s.t, s.handler.Recover(context.Background()))
+	return s
+}
+
+func (s *ServerStage) JournalIsEmpty() *ServerStage {
+	entries, err := os.ReadDir(filepath.Join(s.archivePath, "tmp", "journal"))
+	require.NoError(s.t, err)
+	require.Empty(s.t, entries)
+
+	return s
+}
+
+func (s *ServerStage) IndexIsLost() *ServerStage {
+	client := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_ADDRESS"),
+	})
+	defer client.Close()
+
+	require.NoError(s.t, client.FlushDB(context.Background()).Err())
+
+	return s
+}
+
+// DateIndexesAreLost drops the date indexes only, as if the media had been stored before they existed.
+func (s *ServerStage) DateIndexesAreLost() *ServerStage {
+	client := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_ADDRESS"),
+	})
+	defer client.Close()
+
+	require.NoError(s.t, client.Del(context.Background(), "index:created_at", "index:imported_at").Err())
+
+	return s
+}
+
+// ArchivedFileIsCopied copies the archived file to another directory of the archive.
+func (s *ServerStage) ArchivedFileIsCopied(path string) *ServerStage {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	media, err := s.handler.Repo.Get(context.Background(), hash)
+	require.NoError(s.t, err)
+	require.NotNil(s.t, media)
+
+	s.copyTo(media.Path, filepath.Join(s.archivePath, "copies", filepath.Base(media.Path)))
+
+	return s
+}
+
+func (s *ServerStage) IndexIsRebuilt() *ServerStage {
+	report, err := indexer.NewIndexer(s.handler.Repo, []string{"jpg", "heic"}, zap.NewNop()).Rebuild(context.Background(), s.archivePath)
+	require.NoError(s.t, err)
+	s.reindexReport = report
+
+	return s
+}
+
+func (s *ServerStage) ConflictsAreReported(paths ...string) *ServerStage {
+	var hashes [][]byte
+	for _, path := range paths {
+		hash, err := fs.Hash(path)
+		require.NoError(s.t, err)
+		hashes = append(hashes, hash)
+	}
+
+	var actual [][]byte
+	for _, c := range s.reindexReport.Conflicts {
+		require.Len(s.t, c.Paths, 2)
+		actual = append(actual, c.Hash)
+	}
+	require.ElementsMatch(s.t, hashes, actual)
+
+	return s
+}
+
+func (s *ServerStage) archivedPath(path string) string {
+	hash, err := fs.Hash(path)
+	require.NoError(s.t, err)
+
+	media, err := s.handler.Repo.Get(context.Background(), hash)
+	require.NoError(s.t, err)
+	require.NotNil(s.t, media)
+
+	return media.Path
+}
+
+func (s *ServerStage) ArchivedFileIsCorrupted(path string) *ServerStage {
+	f, err := os.OpenFile(s.archivedPath(path), os.O_WRONLY, 0)
+	require.NoError(s.t, err)
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte("bit rot"), 100)
+	require.NoError(s.t, err)
+
+	return s
+}
+
+func (s *ServerStage) ArchivedFileIsTruncated(path string) *ServerStage {
+	require.NoError(s.t, os.Truncate(s.archivedPath(path), 100))
+	return s
+}
+
+func (s *ServerStage) ArchivedFileIsDeleted(path string) *ServerStage {
+	require.NoError(s.t, os.Remove(s.archivedPath(path)))
+	return s
+}
+
+func (s *ServerStage) ClientScrubsArchive() *ServerStage {
+	res, err := s.client.ScrubArchive(context.Background(), connect.NewRequest(&arkv1.ScrubArchiveRequest{}))
+	require.NoError(s.t, err)
+	s.scrubbed = res.Msg
+
+	return s
+}
+
+func (s *ServerStage) ScrubReports(checked int, missing, truncated, corrupted []string) *ServerStage {
+	actual := func(media []*arkv1.Media) []string {
+		var hashes []string
+		for _, m := range media {
+			hashes = append(hashes, hex.EncodeToString(m.GetHash()))
+		}
+		return hashes
+	}
+	expected := func(paths []string) []string {
+		var hashes []string
+		for _, path := range paths {
+			hash, err := fs.Hash(path)
+			require.NoError(s.t, err)
+			hashes = append(hashes, hex.EncodeToString(hash))
+		}
+		return hashes
+	}
+
+	require.EqualValues(s.t, checked, s.scrubbed.GetChecked())
+	require.ElementsMatch(s.t, expected(missing), actual(s.scrubbed.GetMissing()))
+	require.ElementsMatch(s.t, expected(truncated), actual(s.scrubbed.GetTruncated()))
+	require.ElementsMatch(s.t, expected(corrupted), actual(s.scrubbed.GetCorrupted()))
+
+	return s
+}
+
+func (s *ServerStage) StagingAreaHoldsOrphanedFile(name string, size int, age time.Duration) *ServerStage {
+	path := filepath.Join(s.archivePath, "tmp", name)
+	require.NoError(s.t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(s.t, os.WriteFile(path, make([]byte, size), 0o644))
+
+	modTime := time.Now().Add(-age)
+	require.NoError(s.t, os.Chtimes(path, modTime, modTime))
+
+	return s
+}
+
+func (s *ServerStage) StagingAreaIsSwept(maxAge time.Duration) *ServerStage {
+	reclaimed, err := s.handler.SweepStagingArea(maxAge)
+	require.NoError(s.t, err)
+	s.reclaimed = reclaimed
+
+	return s
+}
+
+func (s *ServerStage) BytesAreReclaimed(expected int64) *ServerStage {
+	require.Equal(s.t, expected, s.reclaimed)
+	return s
+}
+
+func (s *ServerStage) EnrollmentCodeIsCreated(subject string) *ServerStage {
+	code, err := s.handler.NewEnrollment(context.Background(), subject, nil, time.Minute)
+	require.NoError(s.t, err)
+	s.enrollmentCode = code
+
+	return s
+}
+
+func (s *ServerStage) ClientEnrolls() *ServerStage {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(s.t, err)
+
+	encoded, err := auth.MarshalPublicKey(publicKey)
+	require.NoError(s.t, err)
+
+	res, err := s.client.Enroll(context.Background(), connect.NewRequest(&arkv1.EnrollRequest{
+		Code:      s.enrollmentCode,
+		PublicKey: encoded,
+	}))
+	s.enrollment, s.enrollmentError = nil, err
+	if err == nil {
+		s.enrollment = res.Msg
+	}
+
+	return s
+}
+
+func (s *ServerStage) ClientIsEnrolledAs(subject string) *ServerStage {
+	require.NoError(s.t, s.enrollmentError)
+	require.Equal(s.t, subject, s.enrollment.GetKeyId())
+	require.ElementsMatch(s.t, auth.DefaultScopes, s.enrollment.GetScopes())
+	require.FileExists(s.t, filepath.Join(s.keysDir, subject+".pem"))
+
+	// the scopes are granted by the server, whatever the tokens of the client request
+	stored, err := os.ReadFile(filepath.Join(s.keysDir, subject+".scopes"))
+	require.NoError(s.t, err)
+	var scopes []string
+	require.NoError(s.t, json.Unmarshal(stored, &scopes))
+	require.ElementsMatch(s.t, auth.DefaultScopes, scopes)
+
+	return s
+}
+
+func (s *ServerStage) EnrollmentIsRejected() *ServerStage {
+	target := &connect.Error{}
+	if assert.Error(s.t, s.enrollmentError) && assert.ErrorAs(s.t, s.enrollmentError, &target) {
+		require.Equal(s.t, connect.CodeUnauthenticated, target.Code(), target.Error())
+	} else {
+		s.t.FailNow()
+	}
+
+	return s
+}
+
 func (s *ServerStage) UploadSucceeds() *ServerStage {
 	require.NoError(s.t, s.uploadError)
 	return s
@@ -154,3 +843,61 @@ func (s *ServerStage) UploadIsSkipped() *ServerStage {
 
 	return s
 }
+
+func (s *ServerStage) UploadFails() *ServerStage {
+	require.Error(s.t, s.uploadError)
+	return s
+}
+
+func (s *ServerStage) StagingAreaIsEmpty() *ServerStage {
+	entries, err := os.ReadDir(filepath.Join(s.archivePath, "tmp"))
+	require.NoError(s.t, err)
+	require.Empty(s.t, entries)
+
+	return s
+}
+
+func (s *ServerStage) UploadIsRejectedAsCorrupted() *ServerStage {
+	target := &connect.Error{}
+	if assert.Error(s.t, s.uploadError) && assert.ErrorAs(s.t, s.uploadError, &target) {
+		require.Equal(s.t, connect.CodeDataLoss, target.Code(), target.Error())
+	} else {
+		s.t.FailNow()
+	}
+
+	return s
+}
+
+func (s *ServerStage) ArchiveHoldsExactly(paths ...string) *ServerStage {
+	var expected, actual []string
+	for _, path := range paths {
+		hash, err := fs.Hash(path)
+		require.NoError(s.t, err)
+		expected = append(expected, hex.EncodeToString(hash))
+	}
+
+	err := filepath.WalkDir(s.archivePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		hash, err := fs.Hash(path)
+		if err != nil {
+			return err
+		}
+		actual = append(actual, hex.EncodeToString(hash))
+
+		return nil
+	})
+	require.NoError(s.t, err)
+	require.ElementsMatch(s.t, expected, actual)
+
+	return s
+}
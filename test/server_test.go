@@ -2,8 +2,11 @@ package test
 
 import (
 	"testing"
+	"time"
 
 	_ "github.com/fedragon/ark/testing"
+
+	"connectrpc.com/connect"
 )
 
 type ServerTest struct {
@@ -96,3 +99,303 @@ func Test_Server_UploadOrfFile_DiscardsDuplicate(t *testing.T) {
 	s.Then().
 		UploadIsSkipped()
 }
+
+func Test_Server_UploadTruncatedFile_Fails(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		FileDoesNotExist()
+
+	s.When().
+		ClientUploadsTruncatedFile("./test/testdata/a/image.jpg")
+
+	s.Then().
+		UploadFails().And().
+		StagingAreaIsEmpty()
+}
+
+func Test_Server_UploadFileWithWrongHash_Fails(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		FileDoesNotExist()
+
+	s.When().
+		ClientUploadsFileWithWrongHash("./test/testdata/a/image.jpg")
+
+	s.Then().
+		UploadIsRejectedAsCorrupted().And().
+		StagingAreaIsEmpty()
+}
+
+func Test_Server_UploadFile_ResumesInterruptedUpload(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadIsInterruptedHalfway("./test/testdata/a/image.jpg")
+
+	s.When().
+		ClientResumesUpload("./test/testdata/a/image.jpg")
+
+	s.Then().
+		UploadSucceeds()
+}
+
+func Test_Server_FindDuplicates_ReturnsKnownFiles(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		FileExists()
+
+	s.When().
+		ClientLooksForDuplicates("./test/testdata/a/image.jpg", "./test/testdata/a/image.heic")
+
+	s.Then().
+		DuplicatesAreFound("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_UploadFilesWithSameName_KeepsBoth(t *testing.T) {
+	s := NewServerTest(t).Stage
+	createdAt := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.Given().
+		ClientUploadsFileAs("./test/testdata/doge.jpg", "IMG_0001.jpg", createdAt).And().
+		UploadSucceeds()
+
+	s.When().
+		ClientUploadsFileAs("./test/testdata/grumpy-cat.jpg", "IMG_0001.jpg", createdAt)
+
+	s.Then().
+		UploadSucceeds().And().
+		ArchiveHoldsExactly("./test/testdata/doge.jpg", "./test/testdata/grumpy-cat.jpg")
+}
+
+func Test_Server_DownloadFile_Succeeds(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		FileExists()
+
+	s.When().
+		ClientDownloadsFile("./test/testdata/a/image.jpg")
+
+	s.Then().
+		DownloadSucceeds("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_DownloadUnknownFile_Fails(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		FileDoesNotExist()
+
+	s.When().
+		ClientDownloadsFile("./test/testdata/a/image.jpg")
+
+	s.Then().
+		DownloadFailsWith(connect.CodeNotFound)
+}
+
+func Test_Server_ListMedia_ReturnsMediaWithinRange(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFileAs("./test/testdata/grumpy-cat.jpg", "grumpy-cat.jpg", time.Date(2019, 3, 20, 0, 0, 0, 0, time.UTC)).And().
+		ClientUploadsFileAs("./test/testdata/doge.jpg", "doge.jpg", time.Date(2019, 3, 10, 0, 0, 0, 0, time.UTC)).And().
+		ClientUploadsFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		ClientListsMediaCreatedBetween(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC))
+
+	s.Then().
+		MediaAreListedInOrder("./test/testdata/doge.jpg", "./test/testdata/grumpy-cat.jpg")
+}
+
+func Test_Server_ConcurrentUploadsOfSameFile_OnlyOneSucceeds(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientStartsUploadingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		ClientFinishesUploadingFile()
+
+	s.Then().
+		UploadIsAborted().And().
+		PendingUploadSucceeds().And().
+		ArchiveHoldsExactly("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_Shutdown_RollsBackInterruptedUploads(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientStartsUploadingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		ServerShutsDown(100 * time.Millisecond)
+
+	s.Then().
+		StagingAreaIsEmpty().And().
+		FileIsNotReserved("./test/testdata/a/image.jpg").And().
+		ArchiveHoldsExactly()
+}
+
+func Test_Server_Restart_CompletesInterruptedImport(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ServerStopsAfterArchivingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		ServerRestarts().And().
+		ClientUploadsFile("./test/testdata/a/image.jpg")
+
+	s.Then().
+		UploadIsSkipped().And().
+		JournalIsEmpty().And().
+		ArchiveHoldsExactly("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_Restart_RollsBackInterruptedImport(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ServerStopsBeforeArchivingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		ServerRestarts()
+
+	s.Then().
+		JournalIsEmpty().And().
+		ArchiveHoldsExactly()
+}
+
+func Test_Server_RebuildIndex_RestoresLostIndex(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		ClientUploadsFile("./test/testdata/a/image.heic").And().
+		ArchivedFileIsCopied("./test/testdata/a/image.jpg").And().
+		IndexIsLost()
+
+	s.When().
+		IndexIsRebuilt().And().
+		ClientLooksForDuplicates("./test/testdata/a/image.jpg", "./test/testdata/a/image.heic")
+
+	s.Then().
+		DuplicatesAreFound("./test/testdata/a/image.jpg", "./test/testdata/a/image.heic").And().
+		ConflictsAreReported("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_RebuildIndex_BackfillsDateIndexes(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFileAs("./test/testdata/grumpy-cat.jpg", "grumpy-cat.jpg", time.Date(2019, 3, 20, 0, 0, 0, 0, time.UTC)).And().
+		ClientUploadsFileAs("./test/testdata/doge.jpg", "doge.jpg", time.Date(2019, 3, 10, 0, 0, 0, 0, time.UTC)).And().
+		DateIndexesAreLost()
+
+	s.When().
+		IndexIsRebuilt().And().
+		ClientListsMediaCreatedBetween(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC))
+
+	s.Then().
+		MediaAreListedInOrder("./test/testdata/doge.jpg", "./test/testdata/grumpy-cat.jpg")
+}
+
+func Test_Server_ScrubArchive_ReportsDamagedFiles(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		ClientUploadsFile("./test/testdata/a/image.heic").And().
+		ArchivedFileIsCorrupted("./test/testdata/a/image.jpg").And().
+		ArchivedFileIsDeleted("./test/testdata/a/image.heic")
+
+	s.When().
+		ClientScrubsArchive()
+
+	s.Then().
+		ScrubReports(2, []string{"./test/testdata/a/image.heic"}, nil, []string{"./test/testdata/a/image.jpg"})
+}
+
+func Test_Server_ScrubArchive_ReportsTruncatedFiles(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientUploadsFile("./test/testdata/a/image.jpg").And().
+		ArchivedFileIsTruncated("./test/testdata/a/image.jpg")
+
+	s.When().
+		ClientScrubsArchive()
+
+	s.Then().
+		ScrubReports(1, nil, []string{"./test/testdata/a/image.jpg"}, nil)
+}
+
+func Test_Server_SweepStagingArea_DeletesOrphanedFilesOnly(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		StagingAreaHoldsOrphanedFile("orphan.jpg", 1024, 48*time.Hour).And().
+		StagingAreaHoldsOrphanedFile("recent.jpg", 512, time.Hour).And().
+		StagingAreaHoldsOrphanedFile("sessions/abandoned.jpg", 256, 48*time.Hour).And().
+		ClientStartsUploadingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		StagingAreaIsSwept(24 * time.Hour).And().
+		ClientFinishesUploadingFile()
+
+	s.Then().
+		BytesAreReclaimed(1024 + 256).And().
+		PendingUploadSucceeds().And().
+		ArchiveHoldsExactly("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_SweepStagingArea_SkipsUploadsInProgress(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		ClientStartsUploadingFile("./test/testdata/a/image.jpg")
+
+	s.When().
+		StagingAreaIsSwept(0).And().
+		ClientFinishesUploadingFile()
+
+	s.Then().
+		BytesAreReclaimed(0).And().
+		PendingUploadSucceeds().And().
+		ArchiveHoldsExactly("./test/testdata/a/image.jpg")
+}
+
+func Test_Server_Enroll_RegistersPublicKey(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		EnrollmentCodeIsCreated("laptop")
+
+	s.When().
+		ClientEnrolls()
+
+	s.Then().
+		ClientIsEnrolledAs("laptop")
+}
+
+func Test_Server_Enroll_RejectsReusedCode(t *testing.T) {
+	s := NewServerTest(t).Stage
+
+	s.Given().
+		EnrollmentCodeIsCreated("laptop").And().
+		ClientEnrolls()
+
+	s.When().
+		ClientEnrolls()
+
+	s.Then().
+		EnrollmentIsRejected()
+}
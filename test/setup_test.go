@@ -51,7 +51,5 @@ func TestMain(m *testing.M) {
 
 	fmt.Println("Tearing down test environment...")
 
-	_ = os.RemoveAll("archive")
-
 	os.Exit(code)
 }